@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// DefaultTintStrength is how much of TINT_COLOR COLOR_FILTER=tint mixes in.
+const DefaultTintStrength = 0.3
+
+// adjustImage applies the size's optional post-resize stages to img, in
+// this order:
+//
+//	AUTO_LEVELS   stretch each channel to the full range (true/false)
+//	BRIGHTNESS    -100 to 100 percent
+//	CONTRAST      -100 to 100 percent
+//	SATURATION    -100 (grayscale) to 100 percent
+//	GAMMA         gamma correction, 1 is neutral, above 1 lightens
+//	COLOR_FILTER  grayscale, sepia or tint (TINT_COLOR, TINT_STRENGTH 0-1)
+//	SHARPEN       unsharp mask strength (Gaussian sigma), e.g. 0.5
+func adjustImage(img image.Image, size string) (image.Image, error) {
+	levels, err := getSizeEnvBool("AUTO_LEVELS", size, false)
+	if err != nil {
+		return nil, err
+	}
+	if levels {
+		img = autoLevels(img)
+	}
+	if img, err = toneImage(img, size); err != nil {
+		return nil, err
+	}
+	if img, err = colorFilter(img, size); err != nil {
+		return nil, err
+	}
+
+	sharpen, err := getSizeEnvFloat("SHARPEN", size, 0)
+	if err != nil {
+		return nil, err
+	}
+	if sharpen > 0 {
+		img = imaging.Sharpen(img, sharpen)
+	}
+	return img, nil
+}
+
+// autoLevelsClip is the fraction of the darkest and brightest pixels per
+// channel that autoLevels ignores, so a few outliers don't prevent the
+// stretch.
+const autoLevelsClip = 0.005
+
+// autoLevels stretches each color channel of img so its darkest and
+// brightest values span the full range. Stretching the channels separately
+// also neutralizes a color cast.
+func autoLevels(img image.Image) image.Image {
+	src := imaging.Clone(img)
+	var hist [3][256]int
+	total := 0
+	for i := 0; i < len(src.Pix); i += 4 {
+		if src.Pix[i+3] == 0 {
+			continue
+		}
+		for c := 0; c < 3; c++ {
+			hist[c][src.Pix[i+c]]++
+		}
+		total++
+	}
+	if total == 0 {
+		return img
+	}
+
+	var lut [3][256]uint8
+	clip := int(float64(total) * autoLevelsClip)
+	for c := 0; c < 3; c++ {
+		low, high := 0, 255
+		for sum := 0; low < 255; low++ {
+			if sum += hist[c][low]; sum > clip {
+				break
+			}
+		}
+		for sum := 0; high > 0; high-- {
+			if sum += hist[c][high]; sum > clip {
+				break
+			}
+		}
+		for v := 0; v < 256; v++ {
+			if high <= low {
+				lut[c][v] = uint8(v)
+				continue
+			}
+			lut[c][v] = clampUint8(float64(v-low) * 255 / float64(high-low))
+		}
+	}
+	return imaging.AdjustFunc(src, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{R: lut[0][c.R], G: lut[1][c.G], B: lut[2][c.B], A: c.A}
+	})
+}
+
+// toneImage applies the size's BRIGHTNESS, CONTRAST, SATURATION and GAMMA.
+func toneImage(img image.Image, size string) (image.Image, error) {
+	for _, step := range []struct {
+		key    string
+		adjust func(image.Image, float64) *image.NRGBA
+	}{
+		{"BRIGHTNESS", imaging.AdjustBrightness},
+		{"CONTRAST", imaging.AdjustContrast},
+		{"SATURATION", imaging.AdjustSaturation},
+	} {
+		percent, err := getSizeEnvFloat(step.key, size, 0)
+		if err != nil {
+			return nil, err
+		}
+		if percent < -100 || percent > 100 {
+			return nil, fmt.Errorf("invalid value for %s: %v is not between -100 and 100", step.key, percent)
+		}
+		if percent != 0 {
+			img = step.adjust(img, percent)
+		}
+	}
+
+	gamma, err := getSizeEnvFloat("GAMMA", size, 1)
+	if err != nil {
+		return nil, err
+	}
+	if gamma <= 0 {
+		return nil, fmt.Errorf("invalid value for GAMMA: %v must be positive", gamma)
+	}
+	if gamma != 1 {
+		img = imaging.AdjustGamma(img, gamma)
+	}
+	return img, nil
+}
+
+// colorFilter applies the size's COLOR_FILTER to img.
+func colorFilter(img image.Image, size string) (image.Image, error) {
+	switch filter := getSizeEnv("COLOR_FILTER", size); filter {
+	case "", "none":
+		return img, nil
+	case "grayscale":
+		return imaging.Grayscale(img), nil
+	case "sepia":
+		return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+			r, g, b := float64(c.R), float64(c.G), float64(c.B)
+			return color.NRGBA{
+				R: clampUint8(0.393*r + 0.769*g + 0.189*b),
+				G: clampUint8(0.349*r + 0.686*g + 0.168*b),
+				B: clampUint8(0.272*r + 0.534*g + 0.131*b),
+				A: c.A,
+			}
+		}), nil
+	case "tint":
+		value := getSizeEnv("TINT_COLOR", size)
+		if value == "" {
+			return nil, fmt.Errorf("COLOR_FILTER=tint requires TINT_COLOR")
+		}
+		tint, err := parseColor(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for TINT_COLOR: %w", err)
+		}
+		strength, err := getSizeEnvFloat("TINT_STRENGTH", size, DefaultTintStrength)
+		if err != nil {
+			return nil, err
+		}
+		if strength < 0 || strength > 1 {
+			return nil, fmt.Errorf("invalid value for TINT_STRENGTH: %v is not between 0 and 1", strength)
+		}
+		mix := func(v, t uint8) uint8 {
+			return clampUint8(float64(v)*(1-strength) + float64(t)*strength)
+		}
+		return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+			return color.NRGBA{R: mix(c.R, tint.R), G: mix(c.G, tint.G), B: mix(c.B, tint.B), A: c.A}
+		}), nil
+	default:
+		return nil, fmt.Errorf("invalid value for COLOR_FILTER: %q", filter)
+	}
+}
+
+// clampUint8 rounds v to the nearest channel value.
+func clampUint8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, v+0.5)))
+}
+
+// parseRotate validates a rotation in degrees clockwise.
+func parseRotate(degrees int) error {
+	switch degrees {
+	case 0, 90, 180, 270:
+		return nil
+	}
+	return fmt.Errorf("rotation %d must be 90, 180 or 270", degrees)
+}
+
+// parseFlip validates a flip direction: h (mirror left to right) or v
+// (upside down).
+func parseFlip(flip string) error {
+	switch flip {
+	case "", "h", "v":
+		return nil
+	}
+	return fmt.Errorf("flip %q must be h or v", flip)
+}
+
+// transformImage applies the pre-resize corrections in opts to the decoded
+// source: rotation first, then flipping.
+func transformImage(img image.Image, opts imageOptions) image.Image {
+	// imaging rotates counter-clockwise.
+	switch opts.Rotate {
+	case 90:
+		img = imaging.Rotate270(img)
+	case 180:
+		img = imaging.Rotate180(img)
+	case 270:
+		img = imaging.Rotate90(img)
+	}
+	switch opts.Flip {
+	case "h":
+		img = imaging.FlipH(img)
+	case "v":
+		img = imaging.FlipV(img)
+	}
+	return img
+}
+
+// magickTransform returns the ImageMagick arguments for the pre-resize
+// corrections and crop in opts.
+func magickTransform(opts imageOptions) []string {
+	var args []string
+	if opts.Rotate != 0 {
+		args = append(args, "-rotate", strconv.Itoa(opts.Rotate))
+	}
+	switch opts.Flip {
+	case "h":
+		args = append(args, "-flop")
+	case "v":
+		args = append(args, "-flip")
+	}
+	if !opts.Crop.Empty() {
+		r := opts.Crop
+		args = append(args, "-crop", fmt.Sprintf("%dx%d+%d+%d", r.Dx(), r.Dy(), r.Min.X, r.Min.Y), "+repage")
+	}
+	return args
+}
+
+// parseCrop parses a crop rectangle given as X,Y,W,H in source pixels.
+func parseCrop(value string) (image.Rectangle, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("crop %q must be X,Y,W,H", value)
+	}
+	var n [4]int
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || v < 0 {
+			return image.Rectangle{}, fmt.Errorf("crop %q must be X,Y,W,H in pixels", value)
+		}
+		n[i] = v
+	}
+	if n[2] == 0 || n[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("crop %q has an empty size", value)
+	}
+	return image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3]), nil
+}
+
+// cropImage cuts rect out of img. A rectangle reaching past the edges is
+// clipped to the image.
+func cropImage(img image.Image, rect image.Rectangle) (image.Image, error) {
+	bounds := img.Bounds()
+	clipped := rect.Add(bounds.Min).Intersect(bounds)
+	if clipped.Empty() {
+		return nil, fmt.Errorf("crop %v lies outside the %dx%d image", rect, bounds.Dx(), bounds.Dy())
+	}
+	return imaging.Crop(img, clipped), nil
+}
+
+// borderImage draws a frame of BORDER_WIDTH pixels in BORDER_COLOR (black by
+// default) along the edges of img. The frame covers the outermost pixels, so
+// the output keeps its dimensions.
+func borderImage(img image.Image, size string) (image.Image, error) {
+	width, err := getSizeEnvInt("BORDER_WIDTH", size, 0)
+	if err != nil {
+		return nil, err
+	}
+	if width <= 0 {
+		return img, nil
+	}
+	border := color.NRGBA{A: 255}
+	if value := getSizeEnv("BORDER_COLOR", size); value != "" {
+		if border, err = parseColor(value); err != nil {
+			return nil, fmt.Errorf("invalid value for BORDER_COLOR: %w", err)
+		}
+	}
+
+	dst := imaging.Clone(img)
+	b := dst.Bounds()
+	src := image.NewUniform(border)
+	for _, edge := range []image.Rectangle{
+		image.Rect(b.Min.X, b.Min.Y, b.Max.X, b.Min.Y+width),
+		image.Rect(b.Min.X, b.Max.Y-width, b.Max.X, b.Max.Y),
+		image.Rect(b.Min.X, b.Min.Y, b.Min.X+width, b.Max.Y),
+		image.Rect(b.Max.X-width, b.Min.Y, b.Max.X, b.Max.Y),
+	} {
+		draw.Draw(dst, edge.Intersect(b), src, image.Point{}, draw.Over)
+	}
+	return dst, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// runArchive collects the files generated by a run and bundles them into a
+// zip or (gzipped) tar file, chosen by the extension of path. It is safe for
+// concurrent use.
+type runArchive struct {
+	path    string
+	baseDir string
+	mu      sync.Mutex
+	files   []string
+}
+
+// archiveFormat returns the archive format for the extension of path: zip,
+// tar or tar.gz.
+func archiveFormat(path string) (string, error) {
+	name := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip", nil
+	case strings.HasSuffix(name, ".tar"):
+		return "tar", nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz", nil
+	}
+	return "", fmt.Errorf("%s is not a .zip, .tar, .tar.gz or .tgz file", path)
+}
+
+func (a *runArchive) add(files ...string) {
+	a.mu.Lock()
+	a.files = append(a.files, files...)
+	a.mu.Unlock()
+}
+
+// entryName returns the name of file in the archive: its path below the
+// output directory, or its absolute path without the leading slash.
+func (a *runArchive) entryName(file string) string {
+	if rel, err := filepath.Rel(a.baseDir, file); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	return strings.TrimPrefix(filepath.ToSlash(file), "/")
+}
+
+// save writes the archive, replacing the file at path once it is complete.
+func (a *runArchive) save() error {
+	format, err := archiveFormat(a.path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	files := append([]string(nil), a.files...)
+	a.mu.Unlock()
+	sort.Strings(files)
+
+	if err := os.MkdirAll(filepath.Dir(a.path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for archive: %w", err)
+	}
+	tmpFile := a.path + ".tmp"
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	defer os.Remove(tmpFile)
+
+	switch format {
+	case "zip":
+		err = a.writeZip(out, files)
+	case "tar":
+		err = a.writeTar(out, files)
+	case "tar.gz":
+		gz := gzip.NewWriter(out)
+		if err = a.writeTar(gz, files); err == nil {
+			err = gz.Close()
+		}
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if err := os.Rename(tmpFile, a.path); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+func (a *runArchive) writeZip(w io.Writer, files []string) error {
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = a.entryName(file)
+		// Images are compressed already.
+		header.Method = zip.Store
+		entry, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if err := copyFile(entry, file); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func (a *runArchive) writeTar(w io.Writer, files []string) error {
+	tw := tar.NewWriter(w)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = a.entryName(file)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if err := copyFile(tw, file); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// copyFile copies the content of file to w.
+func copyFile(w io.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
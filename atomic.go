@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// tempCounter keeps the temporary names of concurrent writes apart.
+var tempCounter atomic.Int64
+
+// tempPrefix matches the prefix of the temporary names of writeAtomically.
+var tempPrefix = regexp.MustCompile(`^\.go-scale-[0-9]+-[0-9]+-`)
+
+// writeAtomically lets write save its outputs in dir under temporary names,
+// made of a hidden prefix and the final name, and renames them into place
+// once write succeeded. A crash or full disk mid-save thus never leaves a
+// truncated output under its final name. On failure the temporary files are
+// removed.
+func writeAtomically(dir string, write func(prefix string) ([]string, error)) ([]string, error) {
+	prefix := fmt.Sprintf(".go-scale-%d-%d-", os.Getpid(), tempCounter.Add(1))
+	written, err := write(prefix)
+	if err == nil {
+		written, err = renameOutputs(written, func(file string) (string, error) {
+			return filepath.Join(filepath.Dir(file), strings.TrimPrefix(filepath.Base(file), prefix)), nil
+		})
+	}
+	if err != nil {
+		removeTemp(dir, prefix)
+		return nil, err
+	}
+	return written, nil
+}
+
+// finalName returns the name a temporary output of writeAtomically gets once
+// it is renamed into place, for log messages.
+func finalName(file string) string {
+	return filepath.Join(filepath.Dir(file), tempPrefix.ReplaceAllString(filepath.Base(file), ""))
+}
+
+// removeTemp removes the files in dir whose names start with prefix,
+// including the ones a failed write did not report.
+func removeTemp(dir, prefix string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), prefix) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+}
+
+// renameOutputs renames the written outputs to the names returned by rename
+// and returns the new names. The file lists of <name>.formats.json manifests
+// are updated before the manifests themselves are renamed.
+func renameOutputs(written []string, rename func(file string) (string, error)) ([]string, error) {
+	renamed := map[string]string{}
+	var outputs, manifests []string
+	for _, file := range written {
+		if strings.HasSuffix(file, ".formats.json") {
+			manifests = append(manifests, file)
+			continue
+		}
+		name, err := rename(file)
+		if err != nil {
+			return outputs, err
+		}
+		if err := os.Rename(file, name); err != nil {
+			return outputs, fmt.Errorf("failed to rename %s: %w", file, err)
+		}
+		renamed[filepath.Base(file)] = filepath.Base(name)
+		outputs = append(outputs, name)
+	}
+
+	for _, file := range manifests {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return outputs, fmt.Errorf("failed to read manifest: %w", err)
+		}
+		var manifest formatManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return outputs, fmt.Errorf("invalid manifest %s: %w", file, err)
+		}
+		for i, variant := range manifest.Variants {
+			if name, ok := renamed[variant.File]; ok {
+				manifest.Variants[i].File = name
+			}
+		}
+		if data, err = json.MarshalIndent(manifest, "", "  "); err != nil {
+			return outputs, fmt.Errorf("failed to encode manifest: %w", err)
+		}
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			return outputs, fmt.Errorf("failed to write manifest: %w", err)
+		}
+		name, err := rename(file)
+		if err != nil {
+			return outputs, err
+		}
+		if err := os.Rename(file, name); err != nil {
+			return outputs, fmt.Errorf("failed to rename %s: %w", file, err)
+		}
+		outputs = append(outputs, name)
+	}
+	return outputs, nil
+}
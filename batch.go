@@ -0,0 +1,674 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// inputFile is a file to process.
+type inputFile struct {
+	Path      string
+	Dir       string          // directory relative to the input root, mirrored under each size's output directory
+	Sizes     map[string]bool // sizes to produce, nil for the run's sizes
+	Watermark *bool           // watermark override, nil for the -w flag
+	Name      string          // output file name, "" to derive it from Path
+	Taken     time.Time       // capture date for the {year}, {month} and {day} placeholders
+}
+
+// collectInputs returns the files to process for input: the file itself,
+// every image inside a directory, sorted by name, or the images matching a
+// glob pattern. "-" reads a list of files from standard input. With
+// recursive, nested directories are walked too. Files found by walking a
+// directory or expanding a pattern must pass filter.
+func collectInputs(input string, recursive bool, filter nameFilter) ([]inputFile, error) {
+	if input == "-" {
+		return readFileList(input)
+	}
+	if isGlob(input) {
+		return globInputs(input, filter)
+	}
+
+	info, err := os.Stat(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input: %w", err)
+	}
+	if !info.IsDir() {
+		return []inputFile{{Path: input}}, nil
+	}
+
+	var files []inputFile
+	err = filepath.WalkDir(input, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if path != input && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(input, path)
+		if err != nil {
+			return err
+		}
+		if !filter.allows(rel) || !isImage(path) {
+			return nil
+		}
+		dir := filepath.Dir(rel)
+		if dir == "." {
+			dir = ""
+		}
+		files = append(files, inputFile{Path: path, Dir: dir})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", input, err)
+	}
+	log.Printf("[INFO] Found %d images in %s", len(files), input)
+	return files, nil
+}
+
+// isGlob reports whether pattern contains glob metacharacters.
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// globInputs returns the images matching pattern. Besides the filepath.Match
+// syntax, a "**" path element matches any number of directories, e.g.
+// "incoming/**/*.jpg". The directories below the pattern's fixed prefix are
+// mirrored in the outputs.
+func globInputs(pattern string, filter nameFilter) ([]inputFile, error) {
+	pattern = filepath.Clean(pattern)
+	parts := strings.Split(pattern, string(filepath.Separator))
+	fixed := 0
+	for fixed < len(parts)-1 && !isGlob(parts[fixed]) {
+		fixed++
+	}
+	root := strings.Join(parts[:fixed], string(filepath.Separator))
+	if root == "" {
+		root = "."
+		if filepath.IsAbs(pattern) {
+			root = string(filepath.Separator)
+		}
+	}
+	segments := parts[fixed:]
+	for _, segment := range segments {
+		if _, err := filepath.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob pattern %q: %w", pattern, err)
+		}
+	}
+
+	deep := slices.Contains(segments, "**")
+
+	var files []inputFile
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			// Without "**", directories deeper than the pattern cannot match.
+			if !deep && rel != "." && strings.Count(rel, string(filepath.Separator))+1 >= len(segments) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		if !matchGlob(segments, strings.Split(rel, string(filepath.Separator))) || !filter.allows(rel) || !isImage(path) {
+			return nil
+		}
+		dir := filepath.Dir(rel)
+		if dir == "." {
+			dir = ""
+		}
+		files = append(files, inputFile{Path: path, Dir: dir})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand %s: %w", pattern, err)
+	}
+	log.Printf("[INFO] Found %d images matching %s", len(files), pattern)
+	return files, nil
+}
+
+// matchGlob matches the path elements of name against the pattern elements,
+// where "**" matches zero or more elements.
+func matchGlob(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchGlob(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := filepath.Match(pattern[0], name[0])
+	return ok && matchGlob(pattern[1:], name[1:])
+}
+
+// outputPath returns where the output of input at size is written. By
+// default that is OUTPUT_BASE_DIR/<size>/<dir>/<name>; OUTPUT_PATH (per size)
+// replaces it with a template such as "{srcdir}/thumbs/{name}", where {base}
+// is OUTPUT_BASE_DIR, {size} the size, {dir} the input's directory below the
+// walked directory, {srcdir} the directory the input is in, {name} the output
+// file name and {stem} and {ext} its parts, and {year}, {month}, {day},
+// {hour}, {minute} and {second} the input's capture date. An output path that
+// is the input itself is rejected.
+func outputPath(baseDir string, input inputFile, size, name string) (string, error) {
+	template := getSizeEnv("OUTPUT_PATH", size)
+	if template == "" {
+		return filepath.Join(baseDir, size, input.Dir, name), nil
+	}
+	if !strings.Contains(template, "{name}") && !strings.Contains(template, "{stem}") {
+		return "", fmt.Errorf("invalid value for OUTPUT_PATH: %q contains neither {name} nor {stem}", template)
+	}
+	ext := filepath.Ext(name)
+	path := filepath.Clean(strings.NewReplacer(append([]string{
+		"{base}", baseDir,
+		"{size}", size,
+		"{dir}", input.Dir,
+		"{srcdir}", filepath.Dir(input.Path),
+		"{name}", name,
+		"{stem}", strings.TrimSuffix(name, ext),
+		"{ext}", strings.TrimPrefix(ext, "."),
+	}, dateReplacements(input.Taken)...)...).Replace(template))
+	if path == filepath.Clean(input.Path) {
+		return "", fmt.Errorf("output path %s would overwrite the input", path)
+	}
+	return path, nil
+}
+
+// checkSingleOutput checks that a run writing to -o produces one output:
+// one input at one size, without favicons or breakpoints.
+func checkSingleOutput(files []inputFile, cfg runConfig) error {
+	if len(files) != 1 {
+		return fmt.Errorf("needs exactly one input file, got %d", len(files))
+	}
+	if cfg.Favicon || cfg.Breakpoints {
+		return errors.New("cannot be combined with -favicon or -breakpoints")
+	}
+	sizes := cfg.Sizes
+	if files[0].Sizes != nil {
+		sizes = files[0].Sizes
+	}
+	var selected []string
+	for size, enabled := range sizes {
+		if enabled {
+			selected = append(selected, size)
+		}
+	}
+	if len(selected) != 1 {
+		return fmt.Errorf("needs exactly one size, got %d", len(selected))
+	}
+	return nil
+}
+
+// deliverOutput copies file to target, or to standard output for "-".
+func deliverOutput(file, target string) error {
+	if target == "-" {
+		return copyFile(os.Stdout, file)
+	}
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if err := copyFile(out, file); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// dateFields are the OUTPUT_PATH, S3_PREFIX and GCS_PREFIX placeholders
+// filled in from the capture date, with their time layouts.
+var dateFields = []string{"{year}", "{month}", "{day}", "{hour}", "{minute}", "{second}"}
+var dateLayouts = []string{"2006", "01", "02", "15", "04", "05"}
+
+// dateReplacements returns the placeholder and value pairs of dateFields for
+// taken, for a strings.Replacer.
+func dateReplacements(taken time.Time) []string {
+	pairs := make([]string, 0, 2*len(dateFields))
+	for i, field := range dateFields {
+		pairs = append(pairs, field, taken.Format(dateLayouts[i]))
+	}
+	return pairs
+}
+
+// usesDate reports whether the OUTPUT_PATH, S3_PREFIX or GCS_PREFIX of one
+// of sizes needs the capture date.
+func usesDate(sizes map[string]bool) bool {
+	for size, enabled := range sizes {
+		if !enabled {
+			continue
+		}
+		template := getSizeEnv("OUTPUT_PATH", size) + getSizeEnv("S3_PREFIX", size) + getSizeEnv("GCS_PREFIX", size)
+		for _, field := range dateFields {
+			if strings.Contains(template, field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// captureDate returns when file was taken according to its EXIF
+// DateTimeOriginal or CreateDate, read with exiftool, falling back to its
+// modification time.
+func captureDate(file string) time.Time {
+	output, err := exec.Command("exiftool", "-s3", "-d", "%Y-%m-%d %H:%M:%S", "-DateTimeOriginal", "-CreateDate", file).Output()
+	if err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			if taken, err := time.ParseInLocation(time.DateTime, strings.TrimSpace(line), time.Local); err == nil {
+				return taken
+			}
+		}
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// nameFilter selects the files picked up by directory walks and patterns.
+// Patterns without a slash match the file name, e.g. "*_raw.tif"; others
+// match the path relative to the walked directory and may use "**", e.g.
+// "drafts/**".
+type nameFilter struct {
+	Include []string // a file must match one of these, if any are given
+	Exclude []string // a file must match none of these
+}
+
+// parseNameFilter parses comma-separated -include and -exclude patterns.
+func parseNameFilter(include, exclude string) (nameFilter, error) {
+	var filter nameFilter
+	for _, list := range []struct {
+		value    string
+		patterns *[]string
+	}{{include, &filter.Include}, {exclude, &filter.Exclude}} {
+		for _, pattern := range strings.Split(list.value, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nameFilter{}, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			*list.patterns = append(*list.patterns, filepath.Clean(pattern))
+		}
+	}
+	return filter, nil
+}
+
+// allows reports whether the file at rel, relative to the walked directory,
+// passes the filter.
+func (f nameFilter) allows(rel string) bool {
+	if len(f.Include) > 0 && !matchAny(f.Include, rel) {
+		return false
+	}
+	return !matchAny(f.Exclude, rel)
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if !strings.ContainsRune(pattern, filepath.Separator) {
+			if ok, _ := filepath.Match(pattern, filepath.Base(rel)); ok {
+				return true
+			}
+			continue
+		}
+		sep := string(filepath.Separator)
+		if matchGlob(strings.Split(pattern, sep), strings.Split(rel, sep)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readFileList reads the files to process from list, one path per line, as
+// printed by find. Empty lines are ignored. "-" reads standard input.
+func readFileList(list string) ([]inputFile, error) {
+	r := io.Reader(os.Stdin)
+	if list != "-" {
+		f, err := os.Open(list)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file list: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var files []inputFile
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			files = append(files, inputFile{Path: line})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read file list: %w", err)
+	}
+	return files, nil
+}
+
+// Strategies for inputs whose outputs would have the same name, e.g.
+// a/photo.jpg and b/photo.jpg given as separate arguments.
+const (
+	collisionError     = "error"     // fail the later inputs (default)
+	collisionNumber    = "number"    // name the later inputs photo_2.jpg, photo_3.jpg, ...
+	collisionHash      = "hash"      // name every colliding input photo_<hash of its path>.jpg
+	collisionPath      = "path"      // mirror the directory of every colliding input, e.g. s/srv/a/photo.jpg
+	collisionOverwrite = "overwrite" // let the last input win
+)
+
+var collisionStrategies = []string{collisionError, collisionNumber, collisionHash, collisionPath, collisionOverwrite}
+
+// collisionStrategy returns the COLLISION strategy.
+func collisionStrategy() (string, error) {
+	strategy := strings.ToLower(os.Getenv("COLLISION"))
+	if strategy == "" {
+		return collisionError, nil
+	}
+	if !slices.Contains(collisionStrategies, strategy) {
+		return "", fmt.Errorf("invalid value for COLLISION: %q is not one of %s", strategy, strings.Join(collisionStrategies, ", "))
+	}
+	return strategy, nil
+}
+
+// inputName returns the name of input's outputs: its Name, which keeps the
+// output extension when it has none, or one derived from its path.
+func inputName(input inputFile) string {
+	name := outputName(input.Path)
+	if input.Name != "" {
+		if filepath.Ext(input.Name) == "" {
+			return input.Name + filepath.Ext(name)
+		}
+		return input.Name
+	}
+	return name
+}
+
+// resolveCollisions applies strategy to the inputs whose outputs would have
+// the same path at one of the sizes they are produced at, in the order of
+// files. The paths are those of outputPath, so OUTPUT_PATH templates that
+// keep inputs apart are honored. With collisionError, the later inputs are
+// left out and returned as failures.
+func resolveCollisions(files []inputFile, strategy string, cfg runConfig) ([]inputFile, []failure) {
+	if strategy == collisionOverwrite {
+		return files, nil
+	}
+	// first[i] is the earlier input that input i collides with, or -1.
+	first := make([]int, len(files))
+	owners := map[string]int{}
+	for i := range files {
+		first[i] = -1
+		paths := collisionPaths(&files[i], cfg)
+		for _, path := range paths {
+			if owner, ok := owners[path]; ok {
+				first[i] = owner
+				break
+			}
+		}
+		if first[i] >= 0 {
+			continue
+		}
+		for _, path := range paths {
+			owners[path] = i
+		}
+	}
+	colliding := map[int]bool{}
+	for i, owner := range first {
+		if owner >= 0 {
+			colliding[i], colliding[owner] = true, true
+		}
+	}
+
+	var failures []failure
+	dropped := map[int]bool{}
+	counts := map[int]int{}
+	for i := range files {
+		if !colliding[i] {
+			continue
+		}
+		input := &files[i]
+		name := inputName(*input)
+		ext := filepath.Ext(name)
+		switch strategy {
+		case collisionError:
+			if first[i] >= 0 {
+				err := fmt.Errorf("output name %s collides with %s (see COLLISION)", name, files[first[i]].Path)
+				log.Printf("[ERROR] %s: %v", input.Path, err)
+				failures = append(failures, failure{File: input.Path, Err: err})
+				dropped[i] = true
+			}
+			continue
+		case collisionNumber:
+			if first[i] < 0 {
+				continue
+			}
+			counts[first[i]]++
+			input.Name = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), counts[first[i]]+1, ext)
+		case collisionHash:
+			source := input.Path
+			if abs, err := filepath.Abs(source); err == nil {
+				source = abs
+			}
+			sum := sha256.Sum256([]byte(source))
+			input.Name = fmt.Sprintf("%s_%s%s", strings.TrimSuffix(name, ext), hex.EncodeToString(sum[:])[:8], ext)
+		case collisionPath:
+			input.Dir = relativeDir(filepath.Dir(input.Path))
+		}
+		log.Printf("[WARNING] Output name %s of %s collides, writing it as %s", name, input.Path, filepath.Join(input.Dir, inputName(*input)))
+	}
+	if len(dropped) == 0 {
+		return files, failures
+	}
+	var kept []inputFile
+	for i, input := range files {
+		if !dropped[i] {
+			kept = append(kept, input)
+		}
+	}
+	return kept, failures
+}
+
+// collisionPaths returns the output paths of input at the sizes it is
+// produced at, reading its capture date first if they depend on it. Paths
+// that are invalid are left out; processFile reports them.
+func collisionPaths(input *inputFile, cfg runConfig) []string {
+	sizes := cfg.Sizes
+	if input.Sizes != nil {
+		sizes = input.Sizes
+	}
+	if input.Taken.IsZero() && usesDate(sizes) {
+		input.Taken = captureDate(input.Path)
+	}
+	name := inputName(*input)
+	var paths []string
+	for size, enabled := range sizes {
+		if !enabled {
+			continue
+		}
+		path, err := outputPath(cfg.OutputBaseDir, *input, size, name)
+		if err != nil {
+			continue
+		}
+		if cfg.OutFormat != "" && cfg.OutFormat != "auto" {
+			path = withExt(path, cfg.OutFormat)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// relativeDir turns dir into a relative path that stays below an output
+// directory, e.g. "/srv/a" into "srv/a" and "../b" into "b".
+func relativeDir(dir string) string {
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(filepath.Clean(dir)), "/") {
+		if part != "" && part != "." && part != ".." {
+			parts = append(parts, part)
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+// failure is a file, or one size of it, that could not be processed.
+type failure struct {
+	File string
+	Size string // size, or "favicon", that failed; "" for the whole file
+	Err  error
+}
+
+func (f failure) String() string {
+	if f.Size == "" {
+		return fmt.Sprintf("%s: %v", f.File, f.Err)
+	}
+	return fmt.Sprintf("%s as %s: %v", f.File, f.Size, f.Err)
+}
+
+// processFiles processes files with up to jobs workers running at once and
+// returns every failure. Each file uses the configuration current when it
+// starts. With failFast, no new file is started once one has
+// failed; complete reports whether every file was processed.
+func processFiles(files []inputFile, live *liveConfig, jobs int, failFast bool) (failures []failure, complete bool) {
+	queue := make(chan inputFile)
+	var mu sync.Mutex
+	skipped := 0
+	var wg sync.WaitGroup
+	for i := 0; i < min(jobs, len(files)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range queue {
+				mu.Lock()
+				stop := failFast && len(failures) > 0
+				if stop {
+					skipped++
+				}
+				mu.Unlock()
+				if stop {
+					continue
+				}
+				cfg := live.acquire()
+				fileFailures := processFile(file, cfg)
+				live.release()
+				time.Sleep(cfg.Pause)
+				// Failed files are left out of the checkpoint, so a resumed run retries them.
+				if cfg.Checkpoint != nil && len(fileFailures) == 0 {
+					if err := cfg.Checkpoint.markDone(file.Path); err != nil {
+						log.Printf("[ERROR] %v", err)
+					}
+				}
+				mu.Lock()
+				failures = append(failures, fileFailures...)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, file := range files {
+		queue <- file
+	}
+	close(queue)
+	wg.Wait()
+	return failures, skipped == 0
+}
+
+// lowerPriority moves every thread of the process to a lower CPU (renice)
+// and idle IO (ionice) priority. Threads and child processes started later,
+// such as convert or cjpeg, inherit it. Failures are logged and the run
+// continues at normal priority.
+func lowerPriority() {
+	entries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		log.Printf("[WARNING] Failed to lower the process priority: %v", err)
+		return
+	}
+	var tids []string
+	for _, entry := range entries {
+		tids = append(tids, entry.Name())
+	}
+	for _, args := range [][]string{
+		append([]string{"renice", "-n", "10", "-p"}, tids...),
+		append([]string{"ionice", "-c", "3", "-p"}, tids...),
+	} {
+		if output, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			log.Printf("[WARNING] %s failed: %v, output: %s", args[0], err, string(output))
+		}
+	}
+}
+
+// Policies for outputs that already exist.
+const (
+	existingOverwrite = "overwrite" // always regenerate
+	existingSkip      = "skip"      // keep any existing output
+	existingIfNewer   = "if-newer"  // regenerate when the input is newer
+)
+
+// findOutput returns the file that the output nominally at output was
+// written to, or output itself if there is none yet. Some outputs are
+// renamed while they are written: 16-bit outputs are PNG, animated GIFs stay
+// GIF, -out-format auto (auto) keeps the format that won, and the pages of a
+// multi-page TIFF get a _p<N> suffix, from page (all pages for 0, checked by
+// the first).
+func findOutput(output string, auto bool, page int) string {
+	names := []string{output, withExt(output, "png"), withExt(output, "gif")}
+	if auto {
+		for _, format := range autoFormats {
+			names = append(names, withExt(output, format))
+		}
+	}
+	for _, name := range names {
+		for _, file := range []string{name, pageFile(name, max(page, 1))} {
+			if _, err := os.Stat(file); err == nil {
+				return file
+			}
+		}
+	}
+	return output
+}
+
+// keepOutput reports whether the existing output of input can be kept under
+// policy instead of being generated again.
+func keepOutput(input, output, policy string) bool {
+	if policy == existingOverwrite {
+		return false
+	}
+	outInfo, err := os.Stat(output)
+	if err != nil {
+		return false
+	}
+	if policy == existingSkip {
+		return true
+	}
+	inInfo, err := os.Stat(input)
+	return err == nil && !inInfo.ModTime().After(outInfo.ModTime())
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Default range and number of steps of the -breakpoints width ladder.
+const (
+	DefaultBreakpointsMin   = 320
+	DefaultBreakpointsMax   = 2560
+	DefaultBreakpointsCount = 7
+)
+
+// breakpointLadder returns the widths of the BREAKPOINTS_COUNT steps from
+// BREAKPOINTS_MIN to BREAKPOINTS_MAX. The steps are geometric, each width a
+// constant factor larger than the previous one, which looks even to the eye
+// and in file size; the defaults give 320, 453, 640, 905, 1280, 1810 and
+// 2560.
+func breakpointLadder() ([]int, error) {
+	read := func(key string, fallback int) (int, error) {
+		value := os.Getenv(key)
+		if value == "" {
+			return fallback, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid value for %s: %q is not a positive number", key, value)
+		}
+		return n, nil
+	}
+	low, err := read("BREAKPOINTS_MIN", DefaultBreakpointsMin)
+	if err != nil {
+		return nil, err
+	}
+	high, err := read("BREAKPOINTS_MAX", DefaultBreakpointsMax)
+	if err != nil {
+		return nil, err
+	}
+	count, err := read("BREAKPOINTS_COUNT", DefaultBreakpointsCount)
+	if err != nil {
+		return nil, err
+	}
+	if high < low {
+		return nil, fmt.Errorf("invalid value for BREAKPOINTS_MAX: %d is less than BREAKPOINTS_MIN %d", high, low)
+	}
+	if count == 1 || high == low {
+		return []int{high}, nil
+	}
+
+	ratio := math.Pow(float64(high)/float64(low), 1/float64(count-1))
+	var widths []int
+	for i := 0; i < count; i++ {
+		width := int(math.Round(float64(low) * math.Pow(ratio, float64(i))))
+		if len(widths) == 0 || width > widths[len(widths)-1] {
+			widths = append(widths, width)
+		}
+	}
+	return widths, nil
+}
+
+// breakpointWidths returns the widths of the ladder that suit a source
+// sourceWidth pixels wide: the steps below it, plus the source width itself
+// when it is clearly above the last of them, so nothing is upscaled.
+func breakpointWidths(sourceWidth int) ([]int, error) {
+	ladder, err := breakpointLadder()
+	if err != nil {
+		return nil, err
+	}
+	var widths []int
+	for _, width := range ladder {
+		if width <= sourceWidth {
+			widths = append(widths, width)
+		}
+	}
+	if len(widths) == 0 || (widths[len(widths)-1] < ladder[len(ladder)-1] && float64(sourceWidth) > float64(widths[len(widths)-1])*1.1) {
+		widths = append(widths, sourceWidth)
+	}
+	return widths, nil
+}
+
+// sourceBreakpoints returns the breakpoint widths of file, after the
+// rotation and crop of opts. The decode is kept in opts.Source for the sizes.
+func sourceBreakpoints(file string, opts imageOptions) ([]int, error) {
+	img, err := opts.Source.open(file, decodeOptions{Page: opts.Page, NoOrient: opts.NoOrient})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input image: %w", err)
+	}
+	width := img.Bounds().Dx()
+	if opts.Rotate == 90 || opts.Rotate == 270 {
+		width = img.Bounds().Dy()
+	}
+	if !opts.Crop.Empty() {
+		width = min(width, opts.Crop.Dx())
+	}
+	return breakpointWidths(width)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// parseColor parses "#rgb", "#rrggbb", "#rrggbbaa" or "transparent".
+func parseColor(value string) (color.NRGBA, error) {
+	if strings.EqualFold(value, "transparent") {
+		return color.NRGBA{}, nil
+	}
+
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", value)
+	}
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q", value)
+	}
+	return color.NRGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}, nil
+}
+
+// flattenImage composites img onto the size's FLATTEN_COLOR (white by
+// default), for output formats without an alpha channel. Opaque images are
+// returned unchanged.
+func flattenImage(img image.Image, size string) (image.Image, error) {
+	nrgba := imaging.Clone(img)
+	if nrgba.Opaque() {
+		return img, nil
+	}
+	background := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	if value := getSizeEnv("FLATTEN_COLOR", size); value != "" {
+		var err error
+		if background, err = parseColor(value); err != nil {
+			return nil, fmt.Errorf("invalid value for FLATTEN_COLOR: %w", err)
+		}
+		background.A = 255
+	}
+	bounds := nrgba.Bounds()
+	canvas := imaging.New(bounds.Dx(), bounds.Dy(), background)
+	return imaging.Overlay(canvas, nrgba, image.Point{}, 1.0), nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/joho/godotenv"
+)
+
+// keyValues collects the values of a repeatable KEY=VALUE flag.
+type keyValues []string
+
+func (kv *keyValues) String() string {
+	return strings.Join(*kv, ",")
+}
+
+func (kv *keyValues) Set(value string) error {
+	if key, _, ok := strings.Cut(value, "="); !ok || strings.TrimSpace(key) == "" {
+		return fmt.Errorf("%q is not KEY=VALUE", value)
+	}
+	*kv = append(*kv, value)
+	return nil
+}
+
+// configOverrides returns the settings given on the command line: every -set
+// KEY=VALUE, -dimension SIZE=VALUE as DIMENSION_<SIZE>, and the shortcuts for
+// single keys, which are skipped when empty.
+func configOverrides(set, dimensions keyValues, shortcuts map[string]string) map[string]string {
+	overrides := map[string]string{}
+	for key, value := range shortcuts {
+		if value != "" {
+			overrides[key] = value
+		}
+	}
+	for _, kv := range dimensions {
+		size, value, _ := strings.Cut(kv, "=")
+		overrides["DIMENSION_"+strings.ToUpper(strings.TrimSpace(size))] = value
+	}
+	for _, kv := range set {
+		key, value, _ := strings.Cut(kv, "=")
+		overrides[strings.ToUpper(strings.TrimSpace(key))] = value
+	}
+	return overrides
+}
+
+// applyOverrides sets overrides in the environment, taking precedence over
+// the .env file and the exported variables.
+func applyOverrides(overrides map[string]string) error {
+	for key, value := range overrides {
+		if err := os.Setenv(key, value); err != nil {
+			return fmt.Errorf("failed to set %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// profileSettings returns the settings of profile among vars: every
+// <PROFILE>__<KEY>, e.g. PROD__OUTPUT_BASE_DIR, as <KEY>.
+func profileSettings(vars map[string]string, profile string) (map[string]string, error) {
+	if !validSizeName(strings.ToLower(profile)) {
+		return nil, fmt.Errorf("invalid profile %q: may only contain letters and digits", profile)
+	}
+	prefix := strings.ToUpper(profile) + "__"
+	settings := map[string]string{}
+	for key, value := range vars {
+		if name, ok := strings.CutPrefix(key, prefix); ok && name != "" {
+			settings[name] = value
+		}
+	}
+	if len(settings) == 0 {
+		return nil, fmt.Errorf("profile %q has no settings (%sKEY=...)", profile, prefix)
+	}
+	return settings, nil
+}
+
+// environ returns the process environment as a map.
+func environ() map[string]string {
+	vars := map[string]string{}
+	for _, kv := range os.Environ() {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			vars[key] = value
+		}
+	}
+	return vars
+}
+
+// EnvPrefix marks variables that configure the tool in the process
+// environment, e.g. MEDIA_SCALE_OUTPUT_BASE_DIR for OUTPUT_BASE_DIR. They take
+// precedence over the unprefixed variables and the .env file.
+const EnvPrefix = "MEDIA_SCALE_"
+
+// loadConfig loads the configuration into the environment, in layers of
+// increasing precedence: the .env file at envPath, the process environment,
+// its MEDIA_SCALE_ variables, the settings of profile (or PROFILE) and
+// finally overrides. A missing .env file is only an error when required.
+// Secret references are resolved last. It returns the settings from the .env
+// file and the layers above the unprefixed environment, with references
+// rather than secrets.
+func loadConfig(envPath string, required bool, profile string, overrides map[string]string) (map[string]string, error) {
+	settings, err := godotenv.Read(envPath)
+	switch {
+	case err == nil:
+		log.Printf("[INFO] Loading environment variables from %s", envPath)
+		if err := godotenv.Load(envPath); err != nil {
+			return nil, fmt.Errorf("failed to load .env file: %w", err)
+		}
+	case errors.Is(err, fs.ErrNotExist) && !required:
+		log.Printf("[INFO] No %s file, using the environment only", envPath)
+		settings = map[string]string{}
+	default:
+		return nil, fmt.Errorf("failed to load .env file: %w", err)
+	}
+
+	layers := map[string]string{}
+	for key, value := range environ() {
+		if name, ok := strings.CutPrefix(key, EnvPrefix); ok && name != "" {
+			layers[name] = value
+		}
+	}
+	if err := applyOverrides(layers); err != nil {
+		return nil, err
+	}
+
+	if profile == "" {
+		profile = os.Getenv("PROFILE")
+	}
+	if profile != "" {
+		profiled, err := profileSettings(environ(), profile)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[INFO] Using profile %s", profile)
+		for key, value := range profiled {
+			layers[key] = value
+		}
+	}
+	for key, value := range overrides {
+		layers[key] = value
+	}
+	for key, value := range layers {
+		settings[key] = value
+	}
+	if err := applyOverrides(layers); err != nil {
+		return nil, err
+	}
+	return settings, resolveSecrets(settings)
+}
+
+// liveConfig is the configuration of a running batch, which can be replaced
+// between files. A file is processed entirely with the configuration it
+// started with.
+type liveConfig struct {
+	mu  sync.RWMutex
+	cfg runConfig
+}
+
+// acquire returns the current configuration, which is not replaced until
+// release is called.
+func (lc *liveConfig) acquire() runConfig {
+	lc.mu.RLock()
+	return lc.cfg
+}
+
+func (lc *liveConfig) release() {
+	lc.mu.RUnlock()
+}
+
+// reloadOnSIGHUP reloads the configuration with load whenever the process
+// receives SIGHUP. The reload waits for the files being processed to finish
+// and holds back new ones until it is done. The environment is reset to
+// baseEnv, as it was before the first load, so removed and changed .env keys
+// take effect. If the new configuration is invalid, the old one is kept.
+func (lc *liveConfig) reloadOnSIGHUP(baseEnv map[string]string, load func() (runConfig, error)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Printf("[INFO] Received SIGHUP, reloading the configuration")
+		lc.mu.Lock()
+		current := environ()
+		setEnviron(baseEnv)
+		cfg, err := load()
+		if err != nil {
+			setEnviron(current)
+			log.Printf("[ERROR] Failed to reload the configuration, keeping the old one: %v", err)
+		} else {
+			// Run state is not part of the configuration.
+			cfg.State = lc.cfg.State
+			cfg.Checkpoint = lc.cfg.Checkpoint
+			cfg.Names = lc.cfg.Names
+			cfg.Manifest = lc.cfg.Manifest
+			cfg.Archive = lc.cfg.Archive
+			cfg.Latest = lc.cfg.Latest
+			lc.cfg = cfg
+			log.Printf("[INFO] Configuration reloaded")
+		}
+		lc.mu.Unlock()
+	}
+}
+
+// setEnviron replaces the process environment with vars.
+func setEnviron(vars map[string]string) {
+	os.Clearenv()
+	for key, value := range vars {
+		os.Setenv(key, value)
+	}
+}
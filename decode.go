@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// rawExtensions lists the camera RAW formats decoded through dcraw.
+var rawExtensions = map[string]bool{
+	".cr2": true, ".cr3": true, ".nef": true, ".arw": true, ".dng": true,
+	".raf": true, ".orf": true, ".rw2": true, ".pef": true, ".srw": true,
+}
+
+func isRaw(file string) bool {
+	return rawExtensions[strings.ToLower(filepath.Ext(file))]
+}
+
+// decodeOptions controls how inputs that have to be rendered are decoded.
+type decodeOptions struct {
+	Width    int  // target width for vector and document input
+	Height   int  // target height, used when Width is 0; natural size if both are 0
+	Page     int  // 1-based page for multi-page input, 0 for the first
+	NoOrient bool // keep the stored pixel orientation, ignoring EXIF
+}
+
+// openImage decodes file. Formats imaging cannot read are converted by an
+// external decoder first. Vector and document inputs are rendered at the
+// target width so they are never scaled up from a small bitmap.
+func openImage(file string, opts decodeOptions) (image.Image, error) {
+	if isRaw(file) {
+		return openRaw(file)
+	}
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".svg", ".svgz":
+		var side []string
+		switch {
+		case opts.Width > 0:
+			side = []string{"-w", strconv.Itoa(opts.Width)}
+		case opts.Height > 0:
+			side = []string{"-h", strconv.Itoa(opts.Height)}
+		}
+		return runDecoder(func(tmpFile string) *exec.Cmd {
+			return exec.Command("rsvg-convert", append(side, "-f", "png", "-o", tmpFile, file)...)
+		})
+	case ".pdf":
+		page := strconv.Itoa(max(opts.Page, 1))
+		scaleX, scaleY := "-1", "-1"
+		switch {
+		case opts.Width > 0:
+			scaleX = strconv.Itoa(opts.Width)
+		case opts.Height > 0:
+			scaleY = strconv.Itoa(opts.Height)
+		}
+		return runDecoder(func(tmpFile string) *exec.Cmd {
+			// pdftoppm appends the extension to the output prefix itself.
+			prefix := strings.TrimSuffix(tmpFile, ".png")
+			return exec.Command("pdftoppm", "-png", "-singlefile", "-f", page, "-l", page,
+				"-scale-to-x", scaleX, "-scale-to-y", scaleY, file, prefix)
+		})
+	case ".tif", ".tiff":
+		if opts.Page > 1 {
+			return runDecoder(func(tmpFile string) *exec.Cmd {
+				return exec.Command("convert", fmt.Sprintf("%s[%d]", file, opts.Page-1), tmpFile)
+			})
+		}
+		if isCMYK(file) {
+			return openCMYK(file, opts)
+		}
+		return openProfiled(file, opts)
+	case ".heic", ".heif":
+		return runDecoder(func(tmpFile string) *exec.Cmd {
+			return exec.Command("heif-convert", file, tmpFile)
+		})
+	default:
+		if isCMYK(file) {
+			return openCMYK(file, opts)
+		}
+		return openProfiled(file, opts)
+	}
+}
+
+// sourceCache holds the last decode of one input, so every size of a file
+// is generated from a single decode. Each size is still resized from the full
+// source rather than from the next larger size, so the small sizes do not
+// pick up the softness of repeated resampling. A cache belongs to one file
+// and is not safe for concurrent use.
+type sourceCache struct {
+	opts decodeOptions
+	img  image.Image
+}
+
+// open decodes file like openImage, returning the previous decode when it
+// was made with the same options. Bitmap input ignores the target size, so
+// any decode of it can be reused. A nil cache always decodes.
+func (c *sourceCache) open(file string, opts decodeOptions) (image.Image, error) {
+	if c == nil {
+		return openImage(file, opts)
+	}
+	if !isVector(file) {
+		opts.Width, opts.Height = 0, 0
+	}
+	if c.img != nil && c.opts == opts {
+		return c.img, nil
+	}
+	img, err := openImage(file, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.opts, c.img = opts, img
+	return img, nil
+}
+
+// isVector reports whether file is rendered at the target size when decoded.
+func isVector(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".svg", ".svgz", ".pdf":
+		return true
+	}
+	return false
+}
+
+// isCMYK reports whether file decodes to CMYK pixels, as print-ready JPEGs
+// (including Adobe YCCK) and TIFFs do.
+func isCMYK(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	return err == nil && cfg.ColorModel == color.CMYKModel
+}
+
+// openCMYK converts a CMYK image to sRGB. With SRGB_PROFILE set, the
+// conversion is color managed by ImageMagick, using the embedded profile or
+// CMYK_PROFILE for the source. Otherwise the naive CMYK formula is used,
+// which is close but not exact.
+func openCMYK(file string, opts decodeOptions) (image.Image, error) {
+	srgbProfile := os.Getenv("SRGB_PROFILE")
+	if srgbProfile == "" {
+		log.Printf("[WARNING] %s is CMYK and SRGB_PROFILE is not set; converting without color management", file)
+		img, err := imaging.Open(file, imaging.AutoOrientation(!opts.NoOrient))
+		if err != nil {
+			return nil, err
+		}
+		return imaging.Clone(img), nil
+	}
+
+	log.Printf("[INFO] Converting CMYK image %s to sRGB", file)
+	return runDecoder(func(tmpFile string) *exec.Cmd {
+		args := []string{file}
+		if !opts.NoOrient {
+			args = append(args, "-auto-orient")
+		}
+		if cmykProfile := os.Getenv("CMYK_PROFILE"); cmykProfile != "" {
+			args = append(args, "-profile", cmykProfile)
+		}
+		args = append(args, "-profile", srgbProfile, tmpFile)
+		return exec.Command("convert", args...)
+	})
+}
+
+// openRaw decodes a camera RAW file with dcraw. RAW_DECODE=embedded uses the
+// JPEG preview stored in the file instead, which is much faster but limited
+// to whatever resolution the camera embedded.
+func openRaw(file string) (image.Image, error) {
+	args := []string{"-c", "-w", "-T", file}
+	if os.Getenv("RAW_DECODE") == "embedded" {
+		args = []string{"-c", "-e", file}
+	}
+
+	cmd := exec.Command("dcraw", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("dcraw failed: %w, output: %s", err, stderr.String())
+	}
+	return imaging.Decode(bytes.NewReader(output))
+}
+
+// runDecoder runs the command built by newCmd, which must write a PNG to
+// tmpFile, and decodes the result, converting a wide-gamut one to sRGB.
+func runDecoder(newCmd func(tmpFile string) *exec.Cmd) (image.Image, error) {
+	tmp, err := os.CreateTemp("", "go-scale-*.png")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpFile := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpFile)
+
+	cmd := newCmd(tmpFile)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w, output: %s", filepath.Base(cmd.Path), err, string(output))
+	}
+	return openProfiled(tmpFile, decodeOptions{NoOrient: true})
+}
+
+// outputName returns the file name used for the processed copies of file.
+// Inputs whose format cannot be written back are saved as JPEG, or as PNG
+// for SVG so transparency survives.
+func outputName(file string) string {
+	name := filepath.Base(file)
+	if isRaw(file) {
+		return withExt(name, "jpg")
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".svg", ".svgz":
+		return withExt(name, "png")
+	case ".heic", ".heif", ".pdf":
+		return withExt(name, "jpg")
+	}
+	return name
+}
+
+// tiffPageCount returns the number of pages (IFDs) in a TIFF file, or 0 if
+// file is not a readable classic TIFF. imaging only decodes the first page.
+func tiffPageCount(file string) int {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".tif", ".tiff":
+	default:
+		return 0
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	if order.Uint16(header[2:4]) != 42 {
+		return 0
+	}
+
+	pages := 0
+	seen := map[uint32]bool{}
+	buf := make([]byte, 4)
+	for offset := order.Uint32(header[4:8]); offset != 0 && !seen[offset]; pages++ {
+		seen[offset] = true
+		if _, err := f.ReadAt(buf[:2], int64(offset)); err != nil {
+			break
+		}
+		entries := int64(order.Uint16(buf[:2]))
+		if _, err := f.ReadAt(buf, int64(offset)+2+entries*12); err != nil {
+			pages++
+			break
+		}
+		offset = order.Uint32(buf)
+	}
+	return pages
+}
+
+// pageFile inserts a page suffix before the extension: photo.tif becomes
+// photo_p2.tif.
+func pageFile(file string, page int) string {
+	ext := filepath.Ext(file)
+	return fmt.Sprintf("%s_p%d%s", strings.TrimSuffix(file, ext), page, ext)
+}
+
+// isGraphic reports whether file is in a format typically used for logos
+// and illustrations rather than photos.
+func isGraphic(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".png", ".gif", ".svg", ".svgz", ".bmp":
+		return true
+	}
+	return false
+}
+
+func isJPEG(file string) bool {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".jpg", ".jpeg":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// isHighBitDepth reports whether file stores more than 8 bits per channel,
+// as scanned archival TIFFs and 16-bit PNGs do.
+func isHighBitDepth(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return false
+	}
+	switch cfg.ColorModel {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+		return true
+	}
+	return false
+}
+
+// processDeepImage resizes a high bit depth image with ImageMagick, which
+// keeps 16 bits per channel through the whole pipeline; imaging works on
+// 8-bit NRGBA only. The output is written as 16-bit PNG or TIFF. Watermarks
+// and extra formats are not applied to these outputs.
+func processDeepImage(inputFile, outputFile string, dim dimension, opts imageOptions) ([]string, error) {
+	size := opts.Size
+	switch strings.ToLower(filepath.Ext(outputFile)) {
+	case ".png", ".tif", ".tiff":
+	default:
+		outputFile = withExt(outputFile, "png")
+	}
+
+	policy, err := upscalePolicy(size)
+	if err != nil {
+		return nil, err
+	}
+	geometry := dim.geometry()
+	switch policy {
+	case "cap":
+		// ImageMagick's ">" flag only ever shrinks.
+		geometry += ">"
+	case "skip":
+		if bounds, err := imageBounds(inputFile); err == nil {
+			if _, err := limitUpscale(dim, "fit", bounds, size); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	filter, err := resampleFilterName(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Page > 0 {
+		inputFile = fmt.Sprintf("%s[%d]", inputFile, opts.Page-1)
+	}
+	args := []string{inputFile}
+	if !opts.NoOrient {
+		args = append(args, "-auto-orient")
+	}
+	args = append(args, magickTransform(opts)...)
+	args = append(args, "-filter", resampleFilters[filter].Magick, "-resize", geometry, "-depth", "16", outputFile)
+	cmd := exec.Command("convert", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("convert failed: %w, output: %s", err, string(output))
+	}
+
+	log.Printf("[INFO] 16-bit image saved: %s", finalName(outputFile))
+	return []string{outputFile}, nil
+}
+
+// imageBounds returns the bounds of file without decoding its pixels.
+func imageBounds(file string) (image.Rectangle, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	return image.Rect(0, 0, cfg.Width, cfg.Height), nil
+}
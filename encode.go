@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	DefaultJPEGQuality = 95
+	DefaultWebPQuality = 80
+	DefaultAVIFQuality = 60
+	DefaultAVIFSpeed   = 6
+	DefaultJXLQuality  = 90
+	DefaultJXLEffort   = 7
+
+	DefaultPNGQuantQuality = "65-80"
+)
+
+// saveImage writes img to outputFile. The encoder is chosen from the file
+// extension; formats imaging cannot write are handed to external encoders.
+// Encoder settings are looked up for opts.Size.
+func saveImage(img image.Image, outputFile string, opts imageOptions) error {
+	size := opts.Size
+	switch strings.ToLower(filepath.Ext(outputFile)) {
+	case ".jpg", ".jpeg":
+		return saveJPEG(img, outputFile, opts)
+	case ".webp":
+		return saveWebP(img, outputFile, opts)
+	case ".avif":
+		return saveAVIF(img, outputFile, size)
+	case ".jxl":
+		return saveJXL(img, outputFile, opts)
+	case ".png":
+		return savePNG(img, outputFile, size)
+	default:
+		return imaging.Save(img, outputFile)
+	}
+}
+
+// saveJPEG encodes img with the quality from opts.Quality, or JPEG_QUALITY
+// when no override is given. JPEG_ENCODER selects the encoder: "std" (the
+// default) or "mozjpeg". The standard library cannot write 4:4:4 chroma, so
+// the std encoder hands those outputs to ImageMagick. Transparent images are
+// flattened onto FLATTEN_COLOR first.
+func saveJPEG(img image.Image, outputFile string, opts imageOptions) error {
+	img, err := flattenImage(img, opts.Size)
+	if err != nil {
+		return err
+	}
+	quality := opts.Quality
+	if quality == 0 {
+		quality, err = getSizeEnvInt("JPEG_QUALITY", opts.Size, DefaultJPEGQuality)
+		if err != nil {
+			return err
+		}
+	}
+	progressive, err := getSizeEnvBool("JPEG_PROGRESSIVE", opts.Size, false)
+	if err != nil {
+		return err
+	}
+	chroma, err := chromaSubsampling(opts.Size)
+	if err != nil {
+		return err
+	}
+
+	switch encoder := getSizeEnv("JPEG_ENCODER", opts.Size); encoder {
+	case "", "std":
+		if chroma == "444" {
+			return runEncoder(img, func(tmpFile string) *exec.Cmd {
+				args := []string{tmpFile, "-quality", strconv.Itoa(quality), "-sampling-factor", "4:4:4"}
+				if progressive {
+					args = append(args, "-interlace", "JPEG")
+				}
+				return exec.Command("convert", append(args, outputFile)...)
+			})
+		}
+		if err := imaging.Save(img, outputFile, imaging.JPEGQuality(quality)); err != nil {
+			return err
+		}
+		if !progressive {
+			return nil
+		}
+		return makeProgressive(outputFile)
+	case "mozjpeg":
+		return saveMozJPEG(img, outputFile, quality, progressive, chroma)
+	default:
+		return fmt.Errorf("invalid value for JPEG_ENCODER: %q", encoder)
+	}
+}
+
+// saveMozJPEG encodes img with mozjpeg's cjpeg, which produces noticeably
+// smaller files than the standard library at the same quality. MOZJPEG_CJPEG
+// points at the binary when it is not the cjpeg on the PATH.
+func saveMozJPEG(img image.Image, outputFile string, quality int, progressive bool, chroma string) error {
+	cjpeg := os.Getenv("MOZJPEG_CJPEG")
+	if cjpeg == "" {
+		cjpeg = "cjpeg"
+	}
+	return runEncoder(img, func(tmpFile string) *exec.Cmd {
+		args := []string{"-quality", strconv.Itoa(quality), "-optimize"}
+		if !progressive {
+			args = append(args, "-baseline")
+		}
+		if chroma == "444" {
+			args = append(args, "-sample", "1x1")
+		}
+		args = append(args, "-outfile", outputFile, tmpFile)
+		return exec.Command(cjpeg, args...)
+	})
+}
+
+// makeProgressive losslessly rewrites a baseline JPEG as progressive with
+// jpegtran. The standard library encoder only writes baseline JPEGs.
+func makeProgressive(file string) error {
+	tmpFile := file + ".progressive"
+	cmd := exec.Command("jpegtran", "-progressive", "-optimize", "-copy", "all", "-outfile", tmpFile, file)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("jpegtran failed: %w, output: %s", err, string(output))
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// savePNG encodes img and then runs the optimization selected by
+// PNG_OPTIMIZE: "lossless" recompresses with zopflipng, "lossy" first
+// quantizes to a palette with pngquant (PNG_QUANT_QUALITY) and then
+// recompresses.
+func savePNG(img image.Image, outputFile, size string) error {
+	if err := imaging.Save(img, outputFile); err != nil {
+		return err
+	}
+
+	switch mode := getSizeEnv("PNG_OPTIMIZE", size); mode {
+	case "", "off":
+		return nil
+	case "lossy":
+		quality := getSizeEnv("PNG_QUANT_QUALITY", size)
+		if quality == "" {
+			quality = DefaultPNGQuantQuality
+		}
+		cmd := exec.Command("pngquant", "--force", "--skip-if-larger", "--quality="+quality, "--output", outputFile, outputFile)
+		if output, err := cmd.CombinedOutput(); err != nil && !isPNGQuantSkip(err) {
+			return fmt.Errorf("pngquant failed: %w, output: %s", err, string(output))
+		}
+		fallthrough
+	case "lossless":
+		cmd := exec.Command("zopflipng", "-y", outputFile, outputFile)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("zopflipng failed: %w, output: %s", err, string(output))
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid value for PNG_OPTIMIZE: %q", mode)
+	}
+}
+
+// isPNGQuantSkip reports whether pngquant exited because the quantized file
+// would be larger or below the minimum quality. The original is kept then.
+func isPNGQuantSkip(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	code := exitErr.ExitCode()
+	return code == 98 || code == 99
+}
+
+// saveWebP encodes img with cwebp using the quality from WEBP_QUALITY.
+// WEBP_LOSSLESS switches to lossless encoding: "true" always, "auto" only
+// for graphic sources such as PNG logos, where lossy artifacts show most.
+func saveWebP(img image.Image, outputFile string, opts imageOptions) error {
+	quality, err := getSizeEnvInt("WEBP_QUALITY", opts.Size, DefaultWebPQuality)
+	if err != nil {
+		return err
+	}
+
+	chroma, err := chromaSubsampling(opts.Size)
+	if err != nil {
+		return err
+	}
+
+	lossless := false
+	switch mode := getSizeEnv("WEBP_LOSSLESS", opts.Size); mode {
+	case "", "false":
+	case "true":
+		lossless = true
+	case "auto":
+		lossless = opts.Graphic
+	default:
+		return fmt.Errorf("invalid value for WEBP_LOSSLESS: %q", mode)
+	}
+
+	return runEncoder(img, func(tmpFile string) *exec.Cmd {
+		args := []string{"-quiet", "-q", strconv.Itoa(quality)}
+		if lossless {
+			args = append(args, "-lossless", "-exact")
+		} else if chroma == "444" {
+			// Lossy WebP is always 4:2:0; sharp YUV conversion keeps
+			// colored edges and text closest to 4:4:4.
+			args = append(args, "-sharp_yuv")
+		}
+		args = append(args, tmpFile, "-o", outputFile)
+		return exec.Command("cwebp", args...)
+	})
+}
+
+// saveAVIF encodes img with avifenc using AVIF_QUALITY and AVIF_SPEED.
+// Lower speeds spend more effort and produce smaller files.
+func saveAVIF(img image.Image, outputFile, size string) error {
+	quality, err := getSizeEnvInt("AVIF_QUALITY", size, DefaultAVIFQuality)
+	if err != nil {
+		return err
+	}
+	speed, err := getSizeEnvInt("AVIF_SPEED", size, DefaultAVIFSpeed)
+	if err != nil {
+		return err
+	}
+	chroma, err := chromaSubsampling(size)
+	if err != nil {
+		return err
+	}
+	return runEncoder(img, func(tmpFile string) *exec.Cmd {
+		return exec.Command("avifenc", "-q", strconv.Itoa(quality), "-s", strconv.Itoa(speed), "--yuv", chroma, tmpFile, outputFile)
+	})
+}
+
+// chromaSubsampling returns the CHROMA_SUBSAMPLING for size, "420" (the
+// default) or "444". 4:4:4 keeps text and sharp colored edges crisp at the
+// cost of larger files.
+func chromaSubsampling(size string) (string, error) {
+	switch value := strings.ReplaceAll(getSizeEnv("CHROMA_SUBSAMPLING", size), ":", ""); value {
+	case "", "420":
+		return "420", nil
+	case "444":
+		return "444", nil
+	default:
+		return "", fmt.Errorf("invalid value for CHROMA_SUBSAMPLING: %q", value)
+	}
+}
+
+// saveJXL encodes img with cjxl using JXL_QUALITY and JXL_EFFORT. When
+// opts.TranscodeFrom names a JPEG with exactly the pixels of img, that file
+// is transcoded losslessly instead; it can be restored bit for bit.
+func saveJXL(img image.Image, outputFile string, opts imageOptions) error {
+	if opts.TranscodeFrom != "" {
+		cmd := exec.Command("cjxl", "--lossless_jpeg=1", opts.TranscodeFrom, outputFile)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("cjxl failed: %w, output: %s", err, string(output))
+		}
+		return nil
+	}
+
+	quality, err := getSizeEnvInt("JXL_QUALITY", opts.Size, DefaultJXLQuality)
+	if err != nil {
+		return err
+	}
+	effort, err := getSizeEnvInt("JXL_EFFORT", opts.Size, DefaultJXLEffort)
+	if err != nil {
+		return err
+	}
+	return runEncoder(img, func(tmpFile string) *exec.Cmd {
+		return exec.Command("cjxl", "-q", strconv.Itoa(quality), "-e", strconv.Itoa(effort), tmpFile, outputFile)
+	})
+}
+
+// runEncoder writes img to a temporary PNG and runs the command built by
+// newCmd on it. External encoders only accept files, not image.Image values.
+func runEncoder(img image.Image, newCmd func(tmpFile string) *exec.Cmd) error {
+	tmpFile, err := writeTempPNG(img)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+
+	cmd := newCmd(tmpFile)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w, output: %s", filepath.Base(cmd.Path), err, string(output))
+	}
+	return nil
+}
+
+// writeTempPNG saves img to a new temporary PNG file. The caller removes it.
+func writeTempPNG(img image.Image) (string, error) {
+	tmp, err := os.CreateTemp("", "go-scale-*.png")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpFile := tmp.Name()
+
+	if err := imaging.Encode(tmp, img, imaging.PNG); err != nil {
+		tmp.Close()
+		os.Remove(tmpFile)
+		return "", fmt.Errorf("failed to write temporary image: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpFile)
+		return "", fmt.Errorf("failed to write temporary image: %w", err)
+	}
+	return tmpFile, nil
+}
+
+// withExt replaces the extension of file with the one for format.
+func withExt(file, format string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file)) + "." + format
+}
+
+// parseFormats splits a comma-separated list of output formats and rejects
+// the ones saveImage cannot produce.
+func parseFormats(value string) ([]string, error) {
+	var formats []string
+	for _, format := range strings.Split(value, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "" {
+			continue
+		}
+		switch format {
+		case "webp", "avif", "jxl":
+		default:
+			return nil, fmt.Errorf("unsupported output format %q", format)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+// parseOutFormat validates the -out-format value and returns the extension
+// the primary output is written with.
+func parseOutFormat(value string) (string, error) {
+	switch format := strings.ToLower(value); format {
+	case "jpg", "jpeg":
+		return "jpg", nil
+	case "png", "webp", "avif", "jxl", "auto":
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported output format %q", value)
+	}
+}
+
+// autoFormats are the encodings compared by -out-format auto. PNG replaces
+// JPEG for images with transparency.
+var autoFormats = []string{"jpg", "webp", "avif"}
+
+type formatManifest struct {
+	Smallest string          `json:"smallest"`
+	Variants []formatVariant `json:"variants"`
+}
+
+type formatVariant struct {
+	Format string `json:"format"`
+	File   string `json:"file"`
+	Bytes  int64  `json:"bytes"`
+}
+
+// saveSmallest encodes img in every auto format and keeps the smallest
+// file. With opts.KeepAll every encoding is kept and a <name>.formats.json
+// manifest records their sizes. Encoders that fail are skipped.
+func saveSmallest(img image.Image, outputFile string, opts imageOptions) ([]string, error) {
+	var manifest formatManifest
+	var smallest int64
+	for _, format := range autoFormats {
+		if format == "jpg" && !imaging.Clone(img).Opaque() {
+			format = "png"
+		}
+		formatFile := withExt(outputFile, format)
+		if err := saveImage(img, formatFile, opts); err != nil {
+			log.Printf("[WARNING] Failed to encode %s as %s: %v", finalName(outputFile), format, err)
+			continue
+		}
+		info, err := os.Stat(formatFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat %s: %w", formatFile, err)
+		}
+
+		manifest.Variants = append(manifest.Variants, formatVariant{Format: format, File: filepath.Base(formatFile), Bytes: info.Size()})
+		if manifest.Smallest == "" || info.Size() < smallest {
+			manifest.Smallest = format
+			smallest = info.Size()
+		}
+	}
+	if manifest.Smallest == "" {
+		return nil, fmt.Errorf("no format could be encoded")
+	}
+
+	var written []string
+	for _, variant := range manifest.Variants {
+		formatFile := withExt(outputFile, variant.Format)
+		if opts.KeepAll || variant.Format == manifest.Smallest {
+			log.Printf("[INFO] Image saved: %s (%d bytes)", finalName(formatFile), variant.Bytes)
+			written = append(written, formatFile)
+		} else if err := os.Remove(formatFile); err != nil {
+			return written, fmt.Errorf("failed to remove %s: %w", formatFile, err)
+		}
+	}
+	log.Printf("[INFO] Smallest encoding for %s is %s", finalName(outputFile), manifest.Smallest)
+
+	if opts.KeepAll {
+		manifestFile := withExt(outputFile, "formats.json")
+		data, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return written, fmt.Errorf("failed to encode manifest: %w", err)
+		}
+		if err := os.WriteFile(manifestFile, data, 0644); err != nil {
+			return written, fmt.Errorf("failed to write manifest: %w", err)
+		}
+		written = append(written, manifestFile)
+	}
+	return written, nil
+}
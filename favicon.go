@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+)
+
+// faviconFiles maps the favicon set's PNG file names to their edge length.
+var faviconFiles = []struct {
+	Name string
+	Size int
+}{
+	{"favicon-16x16.png", 16},
+	{"favicon-32x32.png", 32},
+	{"favicon-48x48.png", 48},
+	{"apple-touch-icon.png", 180},
+	{"android-chrome-192x192.png", 192},
+	{"android-chrome-512x512.png", 512},
+}
+
+// icoSizes are the sizes bundled into favicon.ico.
+var icoSizes = []int{16, 32, 48}
+
+type webManifestIcon struct {
+	Src   string `json:"src"`
+	Sizes string `json:"sizes"`
+	Type  string `json:"type"`
+}
+
+// generateFavicons writes a complete favicon set for inputFile to outputDir:
+// square PNGs, a multi-size favicon.ico and a site.webmanifest with the
+// Android icons. Non-square sources are centered on a transparent canvas.
+// The file names are prefixed with prefix.
+func generateFavicons(inputFile, outputDir, prefix string) ([]string, error) {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory %s: %w", outputDir, err)
+	}
+	srcImage, err := openImage(inputFile, decodeOptions{Width: 512})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input image: %w", err)
+	}
+
+	var written []string
+	icons := map[int]image.Image{}
+	for _, fav := range faviconFiles {
+		icon := squareIcon(srcImage, fav.Size)
+		icons[fav.Size] = icon
+
+		file := filepath.Join(outputDir, prefix+fav.Name)
+		if err := imaging.Save(icon, file); err != nil {
+			return written, fmt.Errorf("failed to save %s: %w", file, err)
+		}
+		written = append(written, file)
+	}
+
+	icoFile := filepath.Join(outputDir, prefix+"favicon.ico")
+	if err := saveICO(icoFile, icons); err != nil {
+		return written, fmt.Errorf("failed to save %s: %w", icoFile, err)
+	}
+	written = append(written, icoFile)
+
+	manifest := map[string][]webManifestIcon{
+		"icons": {
+			{Src: "/android-chrome-192x192.png", Sizes: "192x192", Type: "image/png"},
+			{Src: "/android-chrome-512x512.png", Sizes: "512x512", Type: "image/png"},
+		},
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return written, fmt.Errorf("failed to encode web manifest: %w", err)
+	}
+	manifestFile := filepath.Join(outputDir, prefix+"site.webmanifest")
+	if err := os.WriteFile(manifestFile, append(data, '\n'), 0644); err != nil {
+		return written, fmt.Errorf("failed to save %s: %w", manifestFile, err)
+	}
+	written = append(written, manifestFile)
+
+	log.Printf("[INFO] Favicon set saved to %s", outputDir)
+	return written, nil
+}
+
+// squareIcon fits img into a size x size transparent square.
+func squareIcon(img image.Image, size int) image.Image {
+	fitted := imaging.Fit(img, size, size, imaging.Lanczos)
+	return imaging.PasteCenter(imaging.New(size, size, color.Transparent), fitted)
+}
+
+// saveICO writes an ICO file embedding the icoSizes icons as PNG images,
+// which every browser that still requests favicon.ico understands.
+func saveICO(file string, icons map[int]image.Image) error {
+	var images [][]byte
+	for _, size := range icoSizes {
+		var buf bytes.Buffer
+		if err := imaging.Encode(&buf, icons[size], imaging.PNG); err != nil {
+			return err
+		}
+		images = append(images, buf.Bytes())
+	}
+
+	var ico bytes.Buffer
+	// ICONDIR: reserved, type (1 = icon), image count.
+	binary.Write(&ico, binary.LittleEndian, [3]uint16{0, 1, uint16(len(images))})
+	offset := 6 + 16*len(images)
+	for i, data := range images {
+		size := uint8(icoSizes[i] % 256) // 0 means 256
+		// ICONDIRENTRY: width, height, palette size, reserved, color planes,
+		// bits per pixel, data size and data offset.
+		ico.Write([]byte{size, size, 0, 0})
+		binary.Write(&ico, binary.LittleEndian, [2]uint16{1, 32})
+		binary.Write(&ico, binary.LittleEndian, [2]uint32{uint32(len(data)), uint32(offset)})
+		offset += len(data)
+	}
+	for _, data := range images {
+		ico.Write(data)
+	}
+	return os.WriteFile(file, ico.Bytes(), 0644)
+}
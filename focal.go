@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// focalPoint is the point of interest of an image, relative to its size:
+// 0,0 is the top-left corner and 1,1 the bottom-right one.
+type focalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// parseFocal parses a -focal value such as "0.3,0.6".
+func parseFocal(value string) (*focalPoint, error) {
+	x, y, ok := strings.Cut(value, ",")
+	if !ok {
+		return nil, fmt.Errorf("focal point %q must be X,Y", value)
+	}
+	var f focalPoint
+	var err error
+	if f.X, err = strconv.ParseFloat(strings.TrimSpace(x), 64); err != nil {
+		return nil, fmt.Errorf("invalid focal X in %q: %w", value, err)
+	}
+	if f.Y, err = strconv.ParseFloat(strings.TrimSpace(y), 64); err != nil {
+		return nil, fmt.Errorf("invalid focal Y in %q: %w", value, err)
+	}
+	return &f, f.validate()
+}
+
+// loadFocalSidecar reads the focal point from <file>.focal.json, e.g.
+// {"x": 0.3, "y": 0.6}. It returns nil when there is no sidecar.
+func loadFocalSidecar(file string) (*focalPoint, error) {
+	data, err := os.ReadFile(file + ".focal.json")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f focalPoint
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid focal point sidecar: %w", err)
+	}
+	return &f, f.validate()
+}
+
+func (f focalPoint) validate() error {
+	if f.X < 0 || f.X > 1 || f.Y < 0 || f.Y > 1 {
+		return fmt.Errorf("focal point %g,%g must be between 0 and 1", f.X, f.Y)
+	}
+	return nil
+}
+
+// in returns the focal point in the pixel coordinates of bounds.
+func (f focalPoint) in(bounds image.Rectangle) image.Point {
+	return image.Pt(
+		bounds.Min.X+int(f.X*float64(bounds.Dx())),
+		bounds.Min.Y+int(f.Y*float64(bounds.Dy())),
+	)
+}
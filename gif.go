@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// isAnimatedGIF reports whether file is a GIF with more than one frame. It
+// walks the blocks of the file up to the second image instead of decoding
+// the frames.
+func isAnimatedGIF(file string) bool {
+	if strings.ToLower(filepath.Ext(file)) != ".gif" {
+		return false
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:4]) != "GIF8" {
+		return false
+	}
+	// Header and logical screen descriptor, then the global color table.
+	if header[10]&0x80 != 0 {
+		if _, err := r.Discard(3 << (header[10]&7 + 1)); err != nil {
+			return false
+		}
+	}
+	frames := 0
+	for {
+		block, err := r.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch block {
+		case 0x21:
+			// Extension: label and data sub-blocks.
+			if _, err := r.ReadByte(); err != nil || skipGIFSubBlocks(r) != nil {
+				return false
+			}
+		case 0x2C:
+			// Image: descriptor, local color table, LZW code size and data.
+			if frames++; frames > 1 {
+				return true
+			}
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return false
+			}
+			if descriptor[8]&0x80 != 0 {
+				if _, err := r.Discard(3 << (descriptor[8]&7 + 1)); err != nil {
+					return false
+				}
+			}
+			if _, err := r.ReadByte(); err != nil || skipGIFSubBlocks(r) != nil {
+				return false
+			}
+		default:
+			// Trailer.
+			return false
+		}
+	}
+}
+
+// skipGIFSubBlocks skips data sub-blocks up to the terminating empty one.
+func skipGIFSubBlocks(r *bufio.Reader) error {
+	for {
+		n, err := r.ReadByte()
+		if err != nil || n == 0 {
+			return err
+		}
+		if _, err := r.Discard(int(n)); err != nil {
+			return err
+		}
+	}
+}
+
+// processAnimatedGIF resizes every frame of inputFile to fit dim and writes
+// an animated GIF to outputFile. Frame positions, delays, disposal methods
+// and palettes are kept. A "webp" format is produced from the resized GIF
+// with gif2webp; other extra formats are skipped.
+func processAnimatedGIF(inputFile, outputFile string, dim dimension, opts imageOptions) ([]string, error) {
+	size := opts.Size
+	filter, err := resampleFilter(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input image: %w", err)
+	}
+	g, err := gif.DecodeAll(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode animated GIF: %w", err)
+	}
+
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if dim, err = limitUpscale(dim, "fit", bounds, size); err != nil {
+		return nil, err
+	}
+	scale := dim.scaleFor(bounds)
+	canvas := image.Rect(0, 0,
+		int(math.Round(float64(g.Config.Width)*scale)),
+		int(math.Round(float64(g.Config.Height)*scale)))
+	for i, frame := range g.Image {
+		g.Image[i] = resizeFrame(frame, scale, canvas, filter)
+	}
+	g.Config.Width = canvas.Dx()
+	g.Config.Height = canvas.Dy()
+
+	if strings.ToLower(filepath.Ext(outputFile)) != ".gif" {
+		outputFile = withExt(outputFile, "gif")
+	}
+	out, err := os.Create(outputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output image: %w", err)
+	}
+	if err := gif.EncodeAll(out, g); err != nil {
+		out.Close()
+		return nil, fmt.Errorf("failed to save output image: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return nil, fmt.Errorf("failed to save output image: %w", err)
+	}
+	log.Printf("[INFO] Animated image saved: %s (%d frames)", finalName(outputFile), len(g.Image))
+	written := []string{outputFile}
+
+	for _, format := range opts.Formats {
+		if format != "webp" {
+			log.Printf("[WARNING] Format %s does not support animation. Skipping for %s.", format, finalName(outputFile))
+			continue
+		}
+		formatFile := withExt(outputFile, format)
+		if err := saveAnimatedWebP(outputFile, formatFile, size); err != nil {
+			return written, fmt.Errorf("failed to save %s output image: %w", format, err)
+		}
+		log.Printf("[INFO] Animated image saved: %s", finalName(formatFile))
+		written = append(written, formatFile)
+	}
+
+	return written, nil
+}
+
+// resizeFrame scales a single GIF frame, including its offset within the
+// canvas, and maps it back onto the frame's own palette.
+func resizeFrame(frame *image.Paletted, scale float64, canvas image.Rectangle, filter imaging.ResampleFilter) *image.Paletted {
+	r := frame.Bounds()
+	bounds := image.Rect(
+		int(math.Floor(float64(r.Min.X)*scale)),
+		int(math.Floor(float64(r.Min.Y)*scale)),
+		int(math.Ceil(float64(r.Max.X)*scale)),
+		int(math.Ceil(float64(r.Max.Y)*scale)),
+	).Intersect(canvas)
+	if bounds.Empty() {
+		bounds = image.Rect(0, 0, 1, 1)
+	}
+
+	resized := imaging.Resize(frame, bounds.Dx(), bounds.Dy(), filter)
+	dst := image.NewPaletted(bounds, frame.Palette)
+	draw.Draw(dst, bounds, resized, image.Point{}, draw.Src)
+	return dst
+}
+
+// saveAnimatedWebP converts an animated GIF into an animated WebP.
+func saveAnimatedWebP(gifFile, outputFile, size string) error {
+	quality, err := getSizeEnvInt("WEBP_QUALITY", size, DefaultWebPQuality)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("gif2webp", "-quiet", "-q", strconv.Itoa(quality), gifFile, "-o", outputFile)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("gif2webp failed: %w, output: %s", err, string(output))
+	}
+	return nil
+}
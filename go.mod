@@ -5,6 +5,8 @@ go 1.22.12
 require (
 	github.com/disintegration/imaging v1.6.2
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/image v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8 // indirect
+require golang.org/x/text v0.19.0 // indirect
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultNameMapFile maps inputs to their hashed output names, relative to
+// OUTPUT_BASE_DIR.
+const DefaultNameMapFile = "hashed-names.json"
+
+// DefaultHashLength is the number of hex digits of the content hash in
+// hashed output names.
+const DefaultHashLength = 12
+
+// nameMap records, for every input and size, the content-hashed names of the
+// outputs, so that a CMS can link an original to its variants. It is safe for
+// concurrent use and keeps the entries of earlier runs.
+type nameMap struct {
+	path    string
+	baseDir string
+	mu      sync.Mutex
+	files   map[string]map[string][]string // input -> size -> outputs
+}
+
+// loadNameMap reads the mapping file at path. Outputs are recorded relative
+// to baseDir when they are below it. A missing file yields an empty map.
+func loadNameMap(path, baseDir string) (*nameMap, error) {
+	m := &nameMap{path: path, baseDir: baseDir, files: map[string]map[string][]string{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read name map: %w", err)
+	}
+	if err := json.Unmarshal(data, &m.files); err != nil {
+		return nil, fmt.Errorf("invalid name map %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// nameMapKey identifies input in the mapping file by its path below the
+// processed directory.
+func nameMapKey(input inputFile) string {
+	return filepath.ToSlash(filepath.Join(input.Dir, filepath.Base(input.Path)))
+}
+
+// lookup returns the outputs recorded for input at size.
+func (m *nameMap) lookup(input inputFile, size string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var outputs []string
+	for _, output := range m.files[nameMapKey(input)][size] {
+		output = filepath.FromSlash(output)
+		if !filepath.IsAbs(output) {
+			output = filepath.Join(m.baseDir, output)
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs
+}
+
+func (m *nameMap) record(input inputFile, size string, outputs []string) {
+	var names []string
+	for _, output := range outputs {
+		if rel, err := filepath.Rel(m.baseDir, output); err == nil && !strings.HasPrefix(rel, "..") {
+			output = rel
+		}
+		names = append(names, filepath.ToSlash(output))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := nameMapKey(input)
+	if m.files[key] == nil {
+		m.files[key] = map[string][]string{}
+	}
+	m.files[key][size] = names
+}
+
+// save writes the mapping file, replacing the previous one atomically.
+func (m *nameMap) save() error {
+	m.mu.Lock()
+	data, err := json.MarshalIndent(m.files, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode name map: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for name map: %w", err)
+	}
+	tmpFile := m.path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write name map: %w", err)
+	}
+	if err := os.Rename(tmpFile, m.path); err != nil {
+		return fmt.Errorf("failed to write name map: %w", err)
+	}
+	return nil
+}
+
+// hashOutputs renames the written outputs to <stem>.<hash>.<ext>, where hash
+// is the first length hex digits of the SHA-256 of the file's content, and
+// returns the new names. A <name>.formats.json manifest keeps its name.
+func hashOutputs(written []string, length int) ([]string, error) {
+	return renameOutputs(written, func(file string) (string, error) {
+		if strings.HasSuffix(file, ".formats.json") {
+			return file, nil
+		}
+		hash, err := fileHash(file)
+		if err != nil {
+			return "", err
+		}
+		ext := filepath.Ext(file)
+		return strings.TrimSuffix(file, ext) + "." + hash[:length] + ext, nil
+	})
+}
+
+// fileHash returns the hex SHA-256 of the content of file.
+func fileHash(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", file, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", file, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashLength returns the HASH_LENGTH of size's hashed names.
+func hashLength(size string) (int, error) {
+	length, err := getSizeEnvInt("HASH_LENGTH", size, DefaultHashLength)
+	if err != nil {
+		return 0, err
+	}
+	if length < 8 || length > 64 {
+		return 0, fmt.Errorf("invalid value for HASH_LENGTH: %d is not between 8 and 64", length)
+	}
+	return length, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// defaultDimensions are the dimensions init suggests for the built-in sizes.
+var defaultDimensions = map[string]string{"s": "200", "m": "500", "l": "1000", "xl": "2000"}
+
+// runInit implements "init": it asks for the essential settings on standard
+// input and writes them to a new .env file. It returns the exit status.
+func runInit(args []string) int {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	envFlag := flags.String("env", DefaultENV, "Path of the .env file to write")
+	forceFlag := flags.Bool("force", false, "Overwrite an existing file")
+	flags.Parse(args)
+
+	if _, err := os.Stat(*envFlag); err == nil && !*forceFlag {
+		log.Printf("[ERROR] %s already exists; use -force to overwrite it", *envFlag)
+		return 1
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("[ERROR] %v", err)
+		return 1
+	}
+
+	settings, err := askSettings(bufio.NewReader(os.Stdin), os.Stdout)
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+		return 1
+	}
+	if err := godotenv.Write(settings, *envFlag); err != nil {
+		log.Printf("[ERROR] Failed to write %s: %v", *envFlag, err)
+		return 1
+	}
+	log.Printf("[INFO] Wrote %s", *envFlag)
+
+	// Check the result like "config validate" would.
+	for key, value := range settings {
+		os.Setenv(key, value)
+	}
+	problems := validateConfig()
+	for _, problem := range problems {
+		log.Printf("[WARNING] %v", problem)
+	}
+	return 0
+}
+
+// askSettings asks for the output directory, dimensions, watermark and owner,
+// repeating a question until the answer is valid.
+func askSettings(in *bufio.Reader, out io.Writer) (map[string]string, error) {
+	ask := func(question, fallback string, valid func(string) error) (string, error) {
+		for {
+			if fallback != "" {
+				fmt.Fprintf(out, "%s [%s]: ", question, fallback)
+			} else {
+				fmt.Fprintf(out, "%s: ", question)
+			}
+			line, err := in.ReadString('\n')
+			if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+				return "", fmt.Errorf("no answer for %q", question)
+			}
+			answer := strings.TrimSpace(line)
+			if answer == "" {
+				answer = fallback
+			}
+			if valid == nil {
+				return answer, nil
+			}
+			if err := valid(answer); err != nil {
+				fmt.Fprintf(out, "  %v\n", err)
+				continue
+			}
+			return answer, nil
+		}
+	}
+
+	settings := map[string]string{}
+	var err error
+	if settings["OUTPUT_BASE_DIR"], err = ask("Output directory", "", func(dir string) error {
+		if dir == "" {
+			return errors.New("an output directory is required")
+		}
+		return checkWritable(dir)
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, size := range builtinSizes {
+		key := "DIMENSION_" + strings.ToUpper(size)
+		question := fmt.Sprintf("Dimension of size %s (WIDTH, WIDTHxHEIGHT or PERCENT%%, - to leave out)", size)
+		value, err := ask(question, defaultDimensions[size], func(value string) error {
+			if value == "-" {
+				return nil
+			}
+			_, err := parseDimension(value)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if value != "-" {
+			settings[key] = value
+		}
+	}
+
+	watermark, err := ask("Watermark image (empty for none)", "", func(file string) error {
+		if file == "" {
+			return nil
+		}
+		_, err := os.Stat(file)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if watermark != "" {
+		settings["WATERMARK_FILE"] = watermark
+	}
+
+	owner := ""
+	if current, err := user.Current(); err == nil {
+		owner = current.Username
+	}
+	if settings["OWNER_USER"], err = ask("Owner of the output files", owner, func(name string) error {
+		_, err := user.Lookup(name)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// dominantColorCount is the number of colors listed per input by
+// -metadata-json.
+const dominantColorCount = 5
+
+// inputMetadata is the -metadata-json sidecar of one input, for a CMS that
+// imports it alongside the outputs.
+type inputMetadata struct {
+	Input   string          `json:"input"`
+	Format  string          `json:"format"`
+	Width   int             `json:"width"`
+	Height  int             `json:"height"`
+	Bytes   int64           `json:"bytes"`
+	EXIF    *exifSummary    `json:"exif,omitempty"`
+	Colors  []dominantColor `json:"colors"`
+	Outputs []manifestEntry `json:"outputs"`
+}
+
+// exifSummary holds the EXIF fields of an input that a CMS typically shows.
+type exifSummary struct {
+	Make         string  `json:"make,omitempty"`
+	Model        string  `json:"model,omitempty"`
+	Lens         string  `json:"lens,omitempty"`
+	Taken        string  `json:"taken,omitempty"`
+	ExposureTime string  `json:"exposure_time,omitempty"`
+	FNumber      float64 `json:"f_number,omitempty"`
+	ISO          int     `json:"iso,omitempty"`
+	FocalLength  float64 `json:"focal_length,omitempty"`
+	Artist       string  `json:"artist,omitempty"`
+	Copyright    string  `json:"copyright,omitempty"`
+}
+
+type dominantColor struct {
+	Hex   string  `json:"hex"`
+	Share float64 `json:"share"`
+}
+
+// describeInput collects the metadata of file, decoded through opts.Source,
+// and its outputs.
+func describeInput(file string, opts imageOptions, outputs []manifestEntry) (inputMetadata, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return inputMetadata{}, err
+	}
+	img, err := opts.Source.open(file, decodeOptions{Page: opts.Page, NoOrient: opts.NoOrient})
+	if err != nil {
+		return inputMetadata{}, fmt.Errorf("failed to open input image: %w", err)
+	}
+	if outputs == nil {
+		outputs = []manifestEntry{}
+	}
+	return inputMetadata{
+		Input:   file,
+		Format:  strings.ToLower(strings.TrimPrefix(filepath.Ext(file), ".")),
+		Width:   img.Bounds().Dx(),
+		Height:  img.Bounds().Dy(),
+		Bytes:   info.Size(),
+		EXIF:    readEXIF(file),
+		Colors:  dominantColors(img, dominantColorCount),
+		Outputs: outputs,
+	}, nil
+}
+
+// readEXIF returns the EXIF summary of file read with exiftool, or nil if
+// it has none or exiftool is not installed.
+func readEXIF(file string) *exifSummary {
+	// The # suffix asks for numbers instead of formatted values like "f/2.8".
+	output, err := exec.Command("exiftool", "-j", "-d", "%Y-%m-%dT%H:%M:%S",
+		"-Make", "-Model", "-LensModel", "-DateTimeOriginal", "-ExposureTime",
+		"-FNumber#", "-ISO#", "-FocalLength#", "-Artist", "-Copyright", file).Output()
+	if err != nil {
+		return nil
+	}
+	var results []map[string]any
+	if err := json.Unmarshal(output, &results); err != nil || len(results) == 0 {
+		return nil
+	}
+	tags := results[0]
+	text := func(key string) string {
+		if value, ok := tags[key]; ok {
+			return strings.TrimSpace(fmt.Sprint(value))
+		}
+		return ""
+	}
+	number := func(key string) float64 {
+		value, _ := tags[key].(float64)
+		return value
+	}
+	summary := exifSummary{
+		Make:         text("Make"),
+		Model:        text("Model"),
+		Lens:         text("LensModel"),
+		Taken:        text("DateTimeOriginal"),
+		ExposureTime: text("ExposureTime"),
+		FNumber:      number("FNumber"),
+		ISO:          int(number("ISO")),
+		FocalLength:  number("FocalLength"),
+		Artist:       text("Artist"),
+		Copyright:    text("Copyright"),
+	}
+	if summary == (exifSummary{}) {
+		return nil
+	}
+	return &summary
+}
+
+// dominantColors returns up to count colors that cover most of img, with
+// their share of its opaque pixels. The pixels of a thumbnail are sorted
+// into buckets of similar colors (3 bits per channel), and the average color
+// of each of the largest buckets is listed.
+func dominantColors(img image.Image, count int) []dominantColor {
+	thumb := imaging.Fit(img, 64, 64, imaging.Box)
+	type bucket struct{ r, g, b, n int }
+	buckets := map[int]*bucket{}
+	total := 0
+	for i := 0; i+3 < len(thumb.Pix); i += 4 {
+		r, g, b, a := int(thumb.Pix[i]), int(thumb.Pix[i+1]), int(thumb.Pix[i+2]), thumb.Pix[i+3]
+		if a < 128 {
+			continue
+		}
+		key := r>>5<<6 | g>>5<<3 | b>>5
+		if buckets[key] == nil {
+			buckets[key] = &bucket{}
+		}
+		bk := buckets[key]
+		bk.r, bk.g, bk.b, bk.n = bk.r+r, bk.g+g, bk.b+b, bk.n+1
+		total++
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		sorted = append(sorted, bk)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].n != sorted[j].n {
+			return sorted[i].n > sorted[j].n
+		}
+		return sorted[i].r+sorted[i].g+sorted[i].b < sorted[j].r+sorted[j].g+sorted[j].b
+	})
+	colors := []dominantColor{}
+	for _, bk := range sorted[:min(count, len(sorted))] {
+		colors = append(colors, dominantColor{
+			Hex:   fmt.Sprintf("#%02x%02x%02x", bk.r/bk.n, bk.g/bk.n, bk.b/bk.n),
+			Share: math.Round(float64(bk.n)/float64(total)*1000) / 1000,
+		})
+	}
+	return colors
+}
+
+// writeInputMetadata writes the sidecar of input to
+// OUTPUT_BASE_DIR/metadata/<dir>/<name>.json and returns its path.
+func writeInputMetadata(meta inputMetadata, input inputFile, baseDir, name string) (string, error) {
+	outputDir := filepath.Join(baseDir, "metadata", input.Dir)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %w", outputDir, err)
+	}
+	file := filepath.Join(outputDir, strings.TrimSuffix(name, filepath.Ext(name))+".json")
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return file, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// job is one entry of a job list: an input plus the settings that override
+// the command line for it. Empty fields keep the run's settings.
+type job struct {
+	Input     string   `json:"input"`
+	Sizes     []string `json:"sizes"`
+	Watermark *bool    `json:"watermark"`
+	Name      string   `json:"name"`
+}
+
+// validFileName reports whether name is a plain file name that stays in the
+// directory it is joined to: no path, no separator and not hidden.
+func validFileName(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("%q is not a plain file name", name)
+	}
+	return nil
+}
+
+// readJobList reads a job list, as JSON when the file name ends in .json and
+// as CSV otherwise. The JSON form is an array of objects such as
+//
+//	{"input": "a.jpg", "sizes": ["s", "m"], "watermark": true, "name": "product-1"}
+//
+// and the CSV form has a header row naming the columns input, sizes (space
+// separated), watermark and name, of which only input is required. Sizes must
+// be among known, and a name must be a plain file name.
+func readJobList(list string, known []string) ([]inputFile, error) {
+	f, err := os.Open(list)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open job list: %w", err)
+	}
+	defer f.Close()
+
+	var jobs []job
+	if strings.EqualFold(filepath.Ext(list), ".json") {
+		if err := json.NewDecoder(f).Decode(&jobs); err != nil {
+			return nil, fmt.Errorf("invalid job list %s: %w", list, err)
+		}
+	} else if jobs, err = readJobCSV(f); err != nil {
+		return nil, fmt.Errorf("invalid job list %s: %w", list, err)
+	}
+
+	files := make([]inputFile, 0, len(jobs))
+	for i, j := range jobs {
+		if j.Input == "" {
+			return nil, fmt.Errorf("invalid job list %s: job %d has no input", list, i+1)
+		}
+		if j.Name != "" {
+			if err := validFileName(j.Name); err != nil {
+				return nil, fmt.Errorf("invalid job list %s: job %d (%s): invalid value for name: %w", list, i+1, j.Input, err)
+			}
+		}
+		file := inputFile{Path: j.Input, Watermark: j.Watermark, Name: j.Name}
+		if len(j.Sizes) > 0 {
+			if file.Sizes, err = parseSizeList(strings.Join(j.Sizes, ","), known); err != nil {
+				return nil, fmt.Errorf("invalid job list %s: job %d: %w", list, i+1, err)
+			}
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// readJobCSV reads the CSV form of a job list.
+func readJobCSV(r io.Reader) ([]job, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["input"]; !ok {
+		return nil, fmt.Errorf("header has no input column")
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var jobs []job
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return jobs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		j := job{
+			Input: field(record, "input"),
+			Sizes: strings.Fields(field(record, "sizes")),
+			Name:  field(record, "name"),
+		}
+		if value := field(record, "watermark"); value != "" {
+			watermark, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid watermark value %q for %s", value, j.Input)
+			}
+			j.Watermark = &watermark
+		}
+		jobs = append(jobs, j)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// latestLinks maintains, per size, stable symlinks such as s/banner-current.jpg
+// pointing at the newest output, so consumers have a fixed path. It is safe
+// for concurrent use.
+type latestLinks struct {
+	name    string
+	mu      sync.Mutex
+	outputs map[string]map[string][]string // size -> input -> outputs
+}
+
+// validLinkName reports whether name can be used for the links: a plain file
+// name without extension.
+func validLinkName(name string) error {
+	if err := validFileName(name); err != nil {
+		return err
+	}
+	if filepath.Ext(name) != "" {
+		return fmt.Errorf("%q has an extension; the output's is added", name)
+	}
+	return nil
+}
+
+func (l *latestLinks) record(size, input string, written []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.outputs == nil {
+		l.outputs = map[string]map[string][]string{}
+	}
+	if l.outputs[size] == nil {
+		l.outputs[size] = map[string][]string{}
+	}
+	l.outputs[size][input] = written
+}
+
+// update points the links of every size at the outputs of the last input
+// among files that produced the size. Each output gets its own link,
+// <name>.<ext> in the output's directory, e.g. one for the JPEG and one for
+// the WebP version, and <name>@2x.<ext> for density variants.
+func (l *latestLinks) update(files []inputFile) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for size, byInput := range l.outputs {
+		for i := len(files) - 1; i >= 0; i-- {
+			written, ok := byInput[files[i].Path]
+			if !ok {
+				continue
+			}
+			for _, file := range written {
+				if strings.HasSuffix(file, ".formats.json") {
+					continue
+				}
+				name := l.name
+				if _, density, ok := strings.Cut(size, "@"); ok {
+					name += "@" + density
+				}
+				link := filepath.Join(filepath.Dir(file), name+filepath.Ext(file))
+				if link == file {
+					log.Printf("[WARNING] Not linking %s to itself (%s)", link, size)
+					continue
+				}
+				if err := replaceSymlink(filepath.Base(file), link); err != nil {
+					return err
+				}
+				log.Printf("[INFO] Linked %s to %s (%s)", link, filepath.Base(file), size)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// replaceSymlink points link at target, replacing an existing link
+// atomically so it never goes missing. Anything else at link, such as an
+// output of the same name, is left alone.
+func replaceSymlink(target, link string) error {
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("failed to create link %s: a file that is not a link is in the way", link)
+	}
+	tmpLink := link + ".tmp"
+	os.Remove(tmpLink)
+	if err := os.Symlink(target, tmpLink); err != nil {
+		return fmt.Errorf("failed to create link %s: %w", link, err)
+	}
+	if err := os.Rename(tmpLink, link); err != nil {
+		os.Remove(tmpLink)
+		return fmt.Errorf("failed to create link %s: %w", link, err)
+	}
+	return nil
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"image"
 	"log"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -18,6 +23,13 @@ import (
 const DefaultENV = ".env"
 
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "validate" {
+		os.Exit(runConfigValidate(os.Args[3:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		os.Exit(runInit(os.Args[2:]))
+	}
+
 	// Command-line flags
 	envFlag := flag.String("env", DefaultENV, "Path to the .env file")
 	watermarkFlag := flag.Bool("w", false, "Add watermark")
@@ -26,137 +38,991 @@ func main() {
 	mediumFlag := flag.Bool("m", false, "Process medium size")
 	largeFlag := flag.Bool("l", false, "Process large size")
 	xlargeFlag := flag.Bool("xl", false, "Process extra-large size")
+	sizesFlag := flag.String("sizes", "", "Comma-separated sizes to process, built-in (s, m, l, xl) or named in SIZES, e.g. thumb,hero")
+	wmOpacityFlag := flag.Float64("wm-opacity", 0, "Watermark opacity (0-1) for all sizes, overrides WATERMARK_OPACITY")
+	qualityFlag := flag.Int("quality", 0, "JPEG quality (1-100) for all sizes, overrides JPEG_QUALITY")
+	pageFlag := flag.Int("page", 0, "Page to process from PDF or multi-page TIFF input (default: first PDF page, every TIFF page)")
+	filterFlag := flag.String("filter", "", "Resampling filter for all sizes (lanczos, catmullrom, mitchell, linear, box, nearest), overrides RESIZE_FILTER")
+	scaleFlag := flag.String("scale", "", "Scale every size by a percentage of the source, e.g. 50%")
+	outFormatFlag := flag.String("out-format", "", "Convert outputs to this format (jpg, png, webp, avif, jxl, auto)")
+	keepAllFlag := flag.Bool("keep-all", false, "With -out-format auto, keep every encoding and write a manifest")
+	rotateFlag := flag.Int("rotate", 0, "Rotate the source clockwise by 90, 180 or 270 degrees before resizing")
+	flipFlag := flag.String("flip", "", "Flip the source before resizing: h (horizontal) or v (vertical)")
+	cropFlag := flag.String("crop", "", "Crop the source to X,Y,W,H (pixels) before resizing")
+	stripMetadataFlag := flag.Bool("strip-metadata", false, "Remove EXIF, GPS, XMP and IPTC metadata from the outputs of every size, overrides STRIP_METADATA")
+	noOrientFlag := flag.Bool("no-orient", false, "Ignore the EXIF orientation tag instead of rotating the image upright")
+	focalFlag := flag.String("focal", "", "Focal point X,Y (0-1) that crops are centered on, overrides <file>.focal.json")
+	faviconFlag := flag.Bool("favicon", false, "Generate a favicon set in OUTPUT_BASE_DIR/favicon")
+	breakpointsFlag := flag.Bool("breakpoints", false, "Also generate a ladder of widths suited to each input, as sizes w<width>")
+	formatFlag := flag.String("format", "", "Comma-separated extra output formats (webp, avif, jxl), overrides OUTPUT_FORMATS")
+	recursiveFlag := flag.Bool("recursive", false, "Process nested directories and mirror their structure in the outputs")
+	includeFlag := flag.String("include", "", "Comma-separated patterns; only matching files are picked up from directories and globs, e.g. *.jpg")
+	excludeFlag := flag.String("exclude", "", "Comma-separated patterns of files to leave out of directories and globs, e.g. *_raw.tif")
+	filesFromFlag := flag.String("files-from", "", "Read the files to process from this file, one per line (- for standard input)")
+	skipExistingFlag := flag.Bool("skip-existing", false, "Keep outputs that already exist instead of regenerating them")
+	ifNewerFlag := flag.Bool("if-newer", false, "Regenerate existing outputs only when the input is newer")
+	overwriteFlag := flag.Bool("overwrite", false, "Regenerate every output, even if it exists (default)")
+	incrementalFlag := flag.Bool("incremental", false, "Only regenerate outputs whose input or settings changed since the last run")
+	jobsFromFlag := flag.String("jobs-from", "", "Read a job list (CSV, or JSON with a .json extension) with per-file sizes, watermark and output name")
+	checkpointFlag := flag.String("checkpoint", "", "Record finished files in this file and skip them when the run is restarted")
+	manifestFlag := flag.String("manifest", "", "Write a JSON manifest of the generated outputs to this file")
+	outputFlag := flag.String("o", "", "Write the output of a single input and size to this file, - for standard output")
+	latestFlag := flag.String("latest", "", "After a run without failures, point <name>.<ext> in each size's directory at the last input's output")
+	archiveFlag := flag.String("archive", "", "Bundle the generated outputs into this .zip, .tar, .tar.gz or .tgz file")
+	metadataJSONFlag := flag.Bool("metadata-json", false, "Write a JSON file with the metadata, dominant colors and outputs of each input to OUTPUT_BASE_DIR/metadata")
+	srcsetFlag := flag.String("srcset", "", "Write a <picture> snippet (html) or srcset description (json) per input to OUTPUT_BASE_DIR/srcset")
+	failFastFlag := flag.Bool("fail-fast", false, "Stop starting new files after the first failure")
+	throttleFlag := flag.Duration("throttle", 0, "Run at low CPU/IO priority, one file at a time (unless -jobs is given), pausing this long after each file")
+	offsetFlag := flag.Int("offset", 0, "Skip this many files of the input list")
+	limitFlag := flag.Int("limit", 0, "Process at most this many files, 0 for no limit")
+	jobsFlag := flag.Int("jobs", runtime.NumCPU(), "Number of files processed in parallel")
+	readMarkFlag := flag.String("read-mark", "", "Print the invisible watermark embedded in this file and exit")
+	var setFlag, dimensionFlag keyValues
+	flag.Var(&setFlag, "set", "Override a config value, KEY=VALUE (repeatable), e.g. -set JPEG_QUALITY_S=70")
+	flag.Var(&dimensionFlag, "dimension", "Override a size's dimension, SIZE=VALUE (repeatable), e.g. -dimension s=320")
+	var metaFlag keyValues
+	flag.Var(&metaFlag, "meta", "Write a metadata tag into every output, TAG=VALUE (repeatable), e.g. -meta \"Artist=Jane Doe\"")
+	profileFlag := flag.String("profile", "", "Config profile to use, e.g. prod for the PROD__ keys (default: PROFILE)")
+	outputDirFlag := flag.String("output-dir", "", "Output directory, overrides OUTPUT_BASE_DIR")
+	watermarkFileFlag := flag.String("watermark-file", "", "Watermark image, overrides WATERMARK_FILE")
 	flag.Parse()
 
+	if *readMarkFlag != "" {
+		// The .env file is optional here, it only provides the strength.
+		_ = godotenv.Load(*envFlag)
+		strength, err := getSizeEnvInt("INVISIBLE_WATERMARK_STRENGTH", "", DefaultStegoStrength)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		img, err := imaging.Open(*readMarkFlag)
+		if err != nil {
+			log.Fatalf("[ERROR] Failed to open %s: %v", *readMarkFlag, err)
+		}
+		payload, err := readInvisibleWatermark(img, strength)
+		if err != nil {
+			log.Fatalf("[ERROR] %s: %v", *readMarkFlag, err)
+		}
+		fmt.Println(payload)
+		return
+	}
+
 	// Validate input arguments
 	args := flag.Args()
-	if len(args) < 1 {
-		log.Fatalf("[ERROR] No input file provided. Usage: %s [options] <file>", os.Args[0])
+	if len(args) < 1 && *filesFromFlag == "" && *jobsFromFlag == "" {
+		log.Fatalf("[ERROR] No input file provided. Usage: %s [options] <file|directory|pattern|->...", os.Args[0])
+	}
+
+	outFormat := ""
+	if *outFormatFlag != "" {
+		var err error
+		if outFormat, err = parseOutFormat(*outFormatFlag); err != nil {
+			log.Fatalf("[ERROR] Invalid -out-format value: %v", err)
+		}
+	}
+
+	for _, kv := range metaFlag {
+		if err := validMetaTag(kv); err != nil {
+			log.Fatalf("[ERROR] Invalid -meta value: %v", err)
+		}
+	}
+	if *srcsetFlag != "" && !slices.Contains(srcsetFormats, *srcsetFlag) {
+		log.Fatalf("[ERROR] Invalid -srcset value: %q is not one of %s", *srcsetFlag, strings.Join(srcsetFormats, ", "))
+	}
+
+	if *latestFlag != "" {
+		if err := validLinkName(*latestFlag); err != nil {
+			log.Fatalf("[ERROR] Invalid -latest value: %v", err)
+		}
+	}
+	if *archiveFlag != "" {
+		if _, err := archiveFormat(*archiveFlag); err != nil {
+			log.Fatalf("[ERROR] Invalid -archive value: %v", err)
+		}
+	}
+
+	var focal *focalPoint
+	var err error
+	if *focalFlag != "" {
+		if focal, err = parseFocal(*focalFlag); err != nil {
+			log.Fatalf("[ERROR] Invalid focal point: %v", err)
+		}
+	}
+
+	if err := parseRotate(*rotateFlag); err != nil {
+		log.Fatalf("[ERROR] Invalid -rotate value: %v", err)
+	}
+	if err := parseFlip(*flipFlag); err != nil {
+		log.Fatalf("[ERROR] Invalid -flip value: %v", err)
 	}
-	file := args[0]
-	log.Printf("[INFO] Processing file: %s", file)
 
-	// Define size processing flags
-	sizes := map[string]bool{
-		"s":  *smallFlag || *allSizesFlag,
-		"m":  *mediumFlag || *allSizesFlag,
-		"l":  *largeFlag || *allSizesFlag,
-		"xl": *xlargeFlag || *allSizesFlag,
+	var crop image.Rectangle
+	if *cropFlag != "" {
+		if crop, err = parseCrop(*cropFlag); err != nil {
+			log.Fatalf("[ERROR] Invalid -crop value: %v", err)
+		}
+	}
+
+	existing := existingOverwrite
+	switch {
+	case *skipExistingFlag && *ifNewerFlag, *skipExistingFlag && *overwriteFlag, *ifNewerFlag && *overwriteFlag:
+		log.Fatalf("[ERROR] Only one of -skip-existing, -if-newer and -overwrite can be used")
+	case *skipExistingFlag:
+		existing = existingSkip
+	case *ifNewerFlag:
+		existing = existingIfNewer
+	}
+
+	filter, err := parseNameFilter(*includeFlag, *excludeFlag)
+	if err != nil {
+		log.Fatalf("[ERROR] Invalid -include or -exclude pattern: %v", err)
+	}
+
+	if *offsetFlag < 0 || *limitFlag < 0 {
+		log.Fatalf("[ERROR] Invalid -offset or -limit value: must not be negative")
+	}
+
+	if *throttleFlag < 0 {
+		log.Fatalf("[ERROR] Invalid -throttle value: %v is negative", *throttleFlag)
+	}
+	jobs := *jobsFlag
+	if *throttleFlag > 0 {
+		jobsSet := false
+		flag.Visit(func(f *flag.Flag) { jobsSet = jobsSet || f.Name == "jobs" })
+		if !jobsSet {
+			jobs = 1
+		}
+		lowerPriority()
+	}
+
+	if *jobsFlag < 1 {
+		log.Fatalf("[ERROR] Invalid -jobs value: %d is less than 1", *jobsFlag)
+	}
+
+	if *wmOpacityFlag < 0 || *wmOpacityFlag > 1 {
+		log.Fatalf("[ERROR] Invalid -wm-opacity value: %v is not between 0 and 1", *wmOpacityFlag)
 	}
+	// -wm-opacity 0 is a valid opacity, so only a given flag overrides.
+	var wmOpacity *float64
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "wm-opacity" {
+			wmOpacity = wmOpacityFlag
+		}
+	})
 
-	// Load environment variables
+	// Load environment variables. loadRunConfig is called again on SIGHUP.
+	// With -o, outputs are written to outputTmpDir and then copied.
+	var outputTmpDir string
 	envPath := *envFlag
-	log.Printf("[INFO] Loading environment variables from %s", envPath)
-	if err := godotenv.Load(envPath); err != nil {
-		log.Fatalf("[ERROR] Failed to load .env file: %v", err)
+	envSet := false
+	flag.Visit(func(f *flag.Flag) { envSet = envSet || f.Name == "env" })
+	loadRunConfig := func() (runConfig, error) {
+		settings, err := loadConfig(envPath, envSet, *profileFlag, configOverrides(setFlag, dimensionFlag, map[string]string{
+			"OUTPUT_BASE_DIR": *outputDirFlag,
+			"WATERMARK_FILE":  *watermarkFileFlag,
+		}))
+		if err != nil {
+			return runConfig{}, err
+		}
+		for _, key := range []string{"OUTPUT_BASE_DIR", "OWNER_USER"} {
+			value := os.Getenv(key)
+			if *outputFlag != "" {
+				continue
+			}
+			if value == "" {
+				return runConfig{}, fmt.Errorf("environment variable %s is not set", key)
+			}
+			log.Printf("[INFO] Loaded environment variable: %s=%s", key, value)
+		}
+
+		// Select the sizes to process, built-in or named in SIZES
+		allSizes, err := configuredSizes()
+		if err != nil {
+			return runConfig{}, err
+		}
+		var sizes map[string]bool
+		if *sizesFlag != "" {
+			if sizes, err = parseSizeList(*sizesFlag, allSizes); err != nil {
+				return runConfig{}, fmt.Errorf("invalid -sizes value: %w", err)
+			}
+		} else {
+			sizes = map[string]bool{
+				"s":  *smallFlag,
+				"m":  *mediumFlag,
+				"l":  *largeFlag,
+				"xl": *xlargeFlag,
+			}
+		}
+		dimensions := map[string]string{}
+		for _, size := range allSizes {
+			dimensions[size] = os.Getenv("DIMENSION_" + strings.ToUpper(size))
+			if *allSizesFlag {
+				sizes[size] = true
+			}
+		}
+		selected := false
+		for _, enabled := range sizes {
+			selected = selected || enabled
+		}
+		if !selected {
+			if sizes, err = defaultSizes(allSizes); err != nil {
+				return runConfig{}, err
+			}
+			// Job lists can select sizes per file, and -favicon and -breakpoints are output too.
+			if len(sizes) == 0 && *jobsFromFlag == "" && !*faviconFlag && !*breakpointsFlag {
+				return runConfig{}, errors.New("no sizes selected: pass -s, -m, -l, -xl, -a or -sizes, or set DEFAULT_SIZES")
+			}
+		}
+
+		cfg := runConfig{
+			Sizes:         sizes,
+			AllSizes:      allSizes,
+			OutputBaseDir: os.Getenv("OUTPUT_BASE_DIR"),
+			OwnerUser:     os.Getenv("OWNER_USER"),
+			Dimensions:    dimensions,
+			Scale:         *scaleFlag,
+			Formats:       *formatFlag,
+			OutFormat:     outFormat,
+			Favicon:       *faviconFlag,
+			Breakpoints:   *breakpointsFlag,
+			Srcset:        *srcsetFlag,
+			MetadataJSON:  *metadataJSONFlag,
+			Existing:      existing,
+			Pause:         *throttleFlag,
+			Output:        *outputFlag,
+			Options: imageOptions{
+				AddWatermark:  *watermarkFlag,
+				Opacity:       wmOpacity,
+				Quality:       *qualityFlag,
+				AutoFormat:    outFormat == "auto",
+				KeepAll:       *keepAllFlag,
+				Page:          *pageFlag,
+				Focal:         focal,
+				Filter:        *filterFlag,
+				NoOrient:      *noOrientFlag,
+				StripMetadata: *stripMetadataFlag,
+				Meta:          metaFlag,
+				Rotate:        *rotateFlag,
+				Flip:          *flipFlag,
+				Crop:          crop,
+			},
+		}
+		if *incrementalFlag {
+			cfg.Settings = settings
+		}
+		if *outputFlag != "" {
+			cfg.OutputBaseDir = outputTmpDir
+			cfg.OwnerUser = ""
+			cfg.Existing = existingOverwrite
+		}
+		return cfg, nil
+	}
+	baseEnv := environ()
+	cfg, err := loadRunConfig()
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	var files []inputFile
+	switch {
+	case *jobsFromFlag != "":
+		files, err = readJobList(*jobsFromFlag, cfg.AllSizes)
+	case *filesFromFlag != "":
+		files, err = readFileList(*filesFromFlag)
+	default:
+		for _, arg := range args {
+			var argFiles []inputFile
+			if argFiles, err = collectInputs(arg, *recursiveFlag, filter); err != nil {
+				break
+			}
+			files = append(files, argFiles...)
+		}
+	}
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	strategy, err := collisionStrategy()
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	files, collisions := resolveCollisions(files, strategy, cfg)
+
+	if *outputFlag != "" {
+		if err := checkSingleOutput(files, cfg); err != nil {
+			log.Fatalf("[ERROR] Invalid -o value: %v", err)
+		}
+		if outputTmpDir, err = os.MkdirTemp("", "go-scale-*"); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		cfg.OutputBaseDir = outputTmpDir
+	}
+
+	if *offsetFlag > 0 || *limitFlag > 0 {
+		total := len(files)
+		start := min(*offsetFlag, total)
+		end := total
+		if *limitFlag > 0 {
+			end = min(start+*limitFlag, total)
+		}
+		files = files[start:end]
+		log.Printf("[INFO] Processing files %d to %d of %d", start+1, end, total)
+		if end < total {
+			log.Printf("[INFO] Continue with -offset %d", end)
+		}
+	}
+
+	if *incrementalFlag {
+		stateFile := os.Getenv("STATE_FILE")
+		if stateFile == "" {
+			stateFile = filepath.Join(cfg.OutputBaseDir, DefaultStateFile)
+		}
+		if cfg.State, err = loadState(stateFile); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+	}
+
+	for _, size := range cfg.AllSizes {
+		if hashNames, _ := getSizeEnvBool("HASH_NAMES", size, false); !hashNames {
+			continue
+		}
+		nameMapFile := os.Getenv("NAME_MAP_FILE")
+		if nameMapFile == "" {
+			nameMapFile = filepath.Join(cfg.OutputBaseDir, DefaultNameMapFile)
+		}
+		if cfg.Names, err = loadNameMap(nameMapFile, cfg.OutputBaseDir); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		break
 	}
 
-	// Read required environment variables
-	outputBaseDir := getEnvOrFail("OUTPUT_BASE_DIR")
-	ownerUser := getEnvOrFail("OWNER_USER")
-	watermarkFile := os.Getenv("WATERMARK_FILE")
+	if *manifestFlag != "" {
+		cfg.Manifest = &runManifest{path: *manifestFlag}
+	}
+	if *archiveFlag != "" {
+		cfg.Archive = &runArchive{path: *archiveFlag, baseDir: cfg.OutputBaseDir}
+	}
+	if *latestFlag != "" {
+		cfg.Latest = &latestLinks{name: *latestFlag}
+	}
+
+	if *checkpointFlag != "" {
+		if cfg.Checkpoint, err = openCheckpoint(*checkpointFlag); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		remaining := cfg.Checkpoint.pending(files)
+		if done := len(files) - len(remaining); done > 0 {
+			log.Printf("[INFO] Resuming from %s: %d of %d files already processed", *checkpointFlag, done, len(files))
+		}
+		files = remaining
+	}
+
+	live := &liveConfig{cfg: cfg}
+	go live.reloadOnSIGHUP(baseEnv, loadRunConfig)
+	failures, complete := processFiles(files, live, jobs, *failFastFlag)
+	failures = append(collisions, failures...)
+
+	// A checkpoint with failed files is kept, so the next run retries them
+	// instead of starting over.
+	if cfg.Checkpoint != nil && complete && len(failures) == 0 {
+		if err := cfg.Checkpoint.remove(); err != nil {
+			log.Printf("[WARNING] Failed to remove checkpoint file: %v", err)
+		}
+	}
+
+	if cfg.State != nil {
+		if err := cfg.State.save(); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+	}
+	if cfg.Names != nil {
+		if err := cfg.Names.save(); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+	}
+	if cfg.Manifest != nil {
+		if err := cfg.Manifest.save(); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		if cfg.Output == "" {
+			if err := uploadManifestGCS(cfg.Manifest.path, cfg.OutputBaseDir); err != nil {
+				log.Fatalf("[ERROR] %v", err)
+			}
+		}
+	}
+	if cfg.Archive != nil {
+		if err := cfg.Archive.save(); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		log.Printf("[INFO] Archive saved: %s", cfg.Archive.path)
+	}
+	if cfg.Latest != nil {
+		if len(failures) > 0 {
+			log.Printf("[WARNING] Not updating the -latest links because of failures")
+		} else if err := cfg.Latest.update(files); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+	}
 
-	dimensions := map[string]string{
-		"s":  os.Getenv("DIMENSION_S"),
-		"m":  os.Getenv("DIMENSION_M"),
-		"l":  os.Getenv("DIMENSION_L"),
-		"xl": os.Getenv("DIMENSION_XL"),
+	if outputTmpDir != "" {
+		os.RemoveAll(outputTmpDir)
 	}
 
+	if len(failures) > 0 {
+		log.Printf("[ERROR] Failures: %d", len(failures))
+		for _, f := range failures {
+			log.Printf("[ERROR]   %v", f)
+		}
+		if !complete {
+			log.Printf("[ERROR] Stopped after the first failure (-fail-fast)")
+		}
+		os.Exit(1)
+	}
+}
+
+// runConfig holds the settings shared by every input of a run.
+type runConfig struct {
+	Sizes         map[string]bool   // sizes to produce
+	AllSizes      []string          // every configured size, built-in and named
+	Dimensions    map[string]string // DIMENSION_* per size
+	OutputBaseDir string
+	OwnerUser     string
+	Scale         string            // -scale percentage, "" for the configured dimensions
+	Formats       string            // -format list, "" for OUTPUT_FORMATS
+	OutFormat     string            // -out-format, "" to keep the input format
+	Favicon       bool              // also generate a favicon set
+	Breakpoints   bool              // also generate the widths of breakpointWidths
+	Srcset        string            // -srcset snippet kind, "" for none
+	MetadataJSON  bool              // write a metadata sidecar per input, from -metadata-json
+	Existing      string            // policy for existing outputs: overwrite, skip or if-newer
+	State         *stateDB          // incremental state, nil to process every input
+	Settings      map[string]string // settings loaded by loadConfig, for the config hash
+	Checkpoint    *checkpoint       // finished inputs of a resumable run, nil for none
+	Names         *nameMap          // hashed output names, nil when no size uses HASH_NAMES
+	Manifest      *runManifest      // outputs generated by the run, nil for no -manifest
+	Archive       *runArchive       // archive of the generated outputs, nil for no -archive
+	Latest        *latestLinks      // symlinks to the newest outputs, nil for no -latest
+	Pause         time.Duration     // pause after each file, from -throttle
+	Output        string            // -o file or "-" for standard output, "" to keep the outputs
+	Options       imageOptions      // per-run image options; the per-size fields are filled in by processFile
+}
+
+// processFile processes one input file at every enabled size. Failures are
+// logged and returned; they do not stop the other sizes.
+func processFile(input inputFile, cfg runConfig) []failure {
+	file := input.Path
+	log.Printf("[INFO] Processing file: %s", file)
+
 	// Validate input file type
 	if !isImage(file) {
-		log.Fatalf("[ERROR] File %s is not a valid image", file)
+		log.Printf("[ERROR] File %s is not a valid image", file)
+		return []failure{{File: file, Err: errors.New("not a valid image")}}
+	}
+
+	opts := cfg.Options
+	opts.Graphic = isGraphic(file)
+	opts.Source = &sourceCache{}
+	if input.Watermark != nil {
+		opts.AddWatermark = *input.Watermark
+	}
+	if opts.Focal == nil {
+		focal, err := loadFocalSidecar(file)
+		if err != nil {
+			log.Printf("[ERROR] Invalid focal point for %s: %v", file, err)
+			return []failure{{File: file, Err: fmt.Errorf("invalid focal point: %w", err)}}
+		}
+		opts.Focal = focal
+	}
+
+	var failures []failure
+	if cfg.Favicon {
+		faviconDir := filepath.Join(cfg.OutputBaseDir, "favicon", input.Dir)
+		written, err := writeAtomically(faviconDir, func(prefix string) ([]string, error) {
+			return generateFavicons(file, faviconDir, prefix)
+		})
+		for _, outputFile := range written {
+			if err := changeOwnership(outputFile, cfg.OwnerUser); err != nil {
+				log.Printf("[ERROR] Failed to change ownership for %s: %v", outputFile, err)
+				failures = append(failures, failure{File: file, Size: "favicon", Err: err})
+			}
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to generate favicons for %s: %v", file, err)
+			failures = append(failures, failure{File: file, Size: "favicon", Err: err})
+		} else if cfg.Archive != nil {
+			cfg.Archive.add(written...)
+		}
+	}
+
+	sizes := cfg.Sizes
+	if input.Sizes != nil {
+		sizes = input.Sizes
+	}
+	side, err := loadSidecar(file, cfg.AllSizes)
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+		return append(failures, failure{File: file, Err: err})
+	}
+	if side != nil {
+		log.Printf("[INFO] Applying overrides from %s%s", file, sidecarSuffix)
+		side.apply(&opts, &sizes)
+	}
+	name := inputName(input)
+
+	dimensions := cfg.Dimensions
+	if cfg.Breakpoints {
+		widths, err := sourceBreakpoints(file, opts)
+		if err != nil {
+			log.Printf("[ERROR] Failed to compute the breakpoints of %s: %v", file, err)
+			return append(failures, failure{File: file, Err: err})
+		}
+		sizes, dimensions = maps.Clone(sizes), maps.Clone(dimensions)
+		for _, width := range widths {
+			size := fmt.Sprintf("w%d", width)
+			sizes[size] = true
+			dimensions[size] = strconv.Itoa(width)
+		}
+		log.Printf("[INFO] Breakpoints for %s: %v", file, widths)
+	}
+
+	if input.Taken.IsZero() && usesDate(sizes) {
+		input.Taken = captureDate(file)
 	}
 
 	// Process each enabled size
+	var generated []manifestEntry
 	for size, enabled := range sizes {
 		if !enabled {
 			continue
 		}
 
-		dimension := dimensions[size]
-		if dimension == "" {
+		baseDimension := dimensions[size]
+		if cfg.Scale != "" {
+			baseDimension = strings.TrimSuffix(cfg.Scale, "%") + "%"
+		}
+		if baseDimension == "" {
 			log.Printf("[WARNING] No dimension found for size %s. Skipping.", size)
 			continue
 		}
-
-		outputDir := filepath.Join(outputBaseDir, size)
-		outputFile := filepath.Join(outputDir, filepath.Base(file))
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
-			log.Fatalf("[ERROR] Failed to create directory %s: %v", outputDir, err)
+		densities, err := parseDensities(getSizeEnv("DPR", size))
+		if err != nil {
+			log.Printf("[ERROR] Invalid DPR for size %s: %v. Skipping.", size, err)
+			failures = append(failures, failure{File: file, Size: size, Err: err})
+			continue
+		}
+		if cfg.Output != "" {
+			densities = []int{1}
 		}
 
-		startTime := time.Now()
-		log.Printf("[INFO] Processing %s as %s (%s pixels)", file, size, dimension)
+		for _, density := range densities {
+			// A density variant is configured like its size, at density times
+			// the dimension, and named photo@2x.jpg.
+			dimension, variantName, label := baseDimension, name, size
+			if density > 1 {
+				if dimension, err = scaleDimension(baseDimension, density); err != nil {
+					log.Printf("[ERROR] Invalid dimension for size %s: %v. Skipping.", size, err)
+					failures = append(failures, failure{File: file, Size: size, Err: err})
+					break
+				}
+				variantName = densityName(name, density)
+				label = fmt.Sprintf("%s@%dx", size, density)
+			}
+
+			formatList := cfg.Formats
+			if formatList == "" {
+				formatList = getSizeEnv("OUTPUT_FORMATS", size)
+			}
+			formats, err := parseFormats(formatList)
+			if err != nil {
+				log.Printf("[ERROR] Invalid output formats for size %s: %v. Skipping.", size, err)
+				failures = append(failures, failure{File: file, Size: label, Err: err})
+				continue
+			}
 
-		err := processImage(file, watermarkFile, outputFile, dimension, size, *watermarkFlag)
+			outputFile, err := outputPath(cfg.OutputBaseDir, input, size, variantName)
+			if cfg.Output != "" {
+				// -o ignores OUTPUT_PATH; the output is copied from a temporary directory.
+				outputFile, err = filepath.Join(cfg.OutputBaseDir, variantName), nil
+			}
+			if err != nil {
+				log.Printf("[ERROR] Invalid output path for %s as %s: %v. Skipping.", file, label, err)
+				failures = append(failures, failure{File: file, Size: label, Err: err})
+				continue
+			}
+			if cfg.OutFormat != "" && cfg.OutFormat != "auto" {
+				outputFile = withExt(outputFile, cfg.OutFormat)
+			}
+			hashNames, err := getSizeEnvBool("HASH_NAMES", size, false)
+			var length int
+			if err == nil && hashNames {
+				length, err = hashLength(size)
+			}
+			if err != nil {
+				log.Printf("[ERROR] Invalid hashed names for size %s: %v. Skipping.", size, err)
+				failures = append(failures, failure{File: file, Size: label, Err: err})
+				continue
+			}
+			existingOutput := findOutput(outputFile, cfg.OutFormat == "auto", cfg.Options.Page)
+			if hashNames {
+				// A hashed output is only known by the name map.
+				existingOutput = ""
+				if cfg.Names != nil {
+					if recorded := cfg.Names.lookup(input, label); len(recorded) > 0 {
+						existingOutput = recorded[0]
+					}
+				}
+			}
+			if keepOutput(file, existingOutput, cfg.Existing) {
+				log.Printf("[INFO] Skipping %s as %s: %s is up to date", file, label, existingOutput)
+				continue
+			}
+
+			opts.Size = size
+			opts.Dimension = dimension
+			opts.Formats = formats
+
+			var stateKeyName string
+			var state stateEntry
+			if cfg.State != nil {
+				info, err := os.Stat(file)
+				if err != nil {
+					log.Printf("[ERROR] Failed to read %s: %v", file, err)
+					failures = append(failures, failure{File: file, Size: label, Err: err})
+					continue
+				}
+				hash, err := configHash(cfg.Settings, cfg.AllSizes, opts)
+				if err != nil {
+					log.Printf("[ERROR] %v", err)
+					failures = append(failures, failure{File: file, Size: label, Err: err})
+					continue
+				}
+				stateKeyName = stateKey(file, label)
+				state = stateEntry{ModTime: info.ModTime(), Config: hash}
+				if cfg.State.upToDate(stateKeyName, state) {
+					log.Printf("[INFO] Skipping %s as %s: unchanged since the last run", file, label)
+					continue
+				}
+			}
+			outputDir := filepath.Dir(outputFile)
+			if err := os.MkdirAll(outputDir, 0755); err != nil {
+				log.Printf("[ERROR] Failed to create directory %s: %v", outputDir, err)
+				failures = append(failures, failure{File: file, Size: label, Err: err})
+				continue
+			}
+
+			startTime := time.Now()
+			log.Printf("[INFO] Processing %s as %s (%s)", file, label, dimension)
+
+			written, err := writeAtomically(outputDir, func(prefix string) ([]string, error) {
+				written, err := processImage(file, filepath.Join(outputDir, prefix+filepath.Base(outputFile)), opts)
+				if err == nil {
+					err = finishMetadata(file, written, opts)
+				}
+				return written, err
+			})
+			for _, outputFile := range written {
+				if err := changeOwnership(outputFile, cfg.OwnerUser); err != nil {
+					log.Printf("[ERROR] Failed to change ownership for %s: %v", outputFile, err)
+					failures = append(failures, failure{File: file, Size: label, Err: err})
+				}
+			}
+			if errors.Is(err, errSkipped) {
+				log.Printf("[WARNING] Skipping %s as %s: %v", file, label, err)
+				continue
+			}
+			if err != nil {
+				log.Printf("[ERROR] Failed to process %s as %s: %v", file, label, err)
+				failures = append(failures, failure{File: file, Size: label, Err: err})
+				continue
+			}
+
+			if hashNames {
+				if written, err = hashOutputs(written, length); err != nil {
+					log.Printf("[ERROR] Failed to hash the outputs of %s as %s: %v", file, label, err)
+					failures = append(failures, failure{File: file, Size: label, Err: err})
+					continue
+				}
+				if cfg.Names != nil {
+					cfg.Names.record(input, label, written)
+				}
+			}
+
+			if cfg.Output == "" {
+				if err := uploadOutputs(input, size, written); err != nil {
+					log.Printf("[ERROR] Failed to upload %s as %s: %v", file, label, err)
+					failures = append(failures, failure{File: file, Size: label, Err: err})
+					continue
+				}
+			}
+
+			if cfg.State != nil && len(written) > 0 {
+				state.Output = written[0]
+				cfg.State.record(stateKeyName, state)
+			}
+
+			duration := time.Since(startTime)
+			if cfg.Manifest != nil || cfg.Srcset != "" || cfg.MetadataJSON {
+				entries := describeOutputs(file, label, written, duration)
+				if cfg.Manifest != nil {
+					cfg.Manifest.record(entries)
+				}
+				generated = append(generated, entries...)
+			}
+			if cfg.Archive != nil {
+				cfg.Archive.add(written...)
+			}
+			if cfg.Latest != nil {
+				cfg.Latest.record(label, file, written)
+			}
+			if cfg.Output != "" && len(written) > 0 {
+				if err := deliverOutput(written[0], cfg.Output); err != nil {
+					log.Printf("[ERROR] Failed to write %s as %s to %s: %v", file, label, cfg.Output, err)
+					failures = append(failures, failure{File: file, Size: label, Err: err})
+					continue
+				}
+			}
+			log.Printf("[INFO] Successfully processed %s as %s in %v", file, label, duration)
+		}
+	}
+
+	if cfg.Srcset != "" {
+		if snippet, ok := buildPicture(file, cfg.OutputBaseDir, generated); ok {
+			snippetFile, err := writePicture(snippet, input, cfg.OutputBaseDir, name, cfg.Srcset)
+			if err == nil {
+				err = changeOwnership(snippetFile, cfg.OwnerUser)
+			}
+			if err == nil && cfg.Output == "" {
+				err = uploadManifestGCS(snippetFile, cfg.OutputBaseDir)
+			}
+			if err != nil {
+				log.Printf("[ERROR] Failed to write the srcset of %s: %v", file, err)
+				failures = append(failures, failure{File: file, Size: "srcset", Err: err})
+			} else if cfg.Archive != nil {
+				cfg.Archive.add(snippetFile)
+			}
+		}
+	}
+	if cfg.MetadataJSON {
+		meta, err := describeInput(file, opts, generated)
+		var metaFile string
+		if err == nil {
+			metaFile, err = writeInputMetadata(meta, input, cfg.OutputBaseDir, name)
+		}
+		if err == nil {
+			err = changeOwnership(metaFile, cfg.OwnerUser)
+		}
+		if err == nil && cfg.Output == "" {
+			err = uploadManifestGCS(metaFile, cfg.OutputBaseDir)
+		}
 		if err != nil {
-			log.Printf("[ERROR] Failed to process %s as %s: %v", file, size, err)
-			continue
+			log.Printf("[ERROR] Failed to write the metadata of %s: %v", file, err)
+			failures = append(failures, failure{File: file, Size: "metadata", Err: err})
+		} else if cfg.Archive != nil {
+			cfg.Archive.add(metaFile)
 		}
+	}
+	return failures
+}
 
-		duration := time.Since(startTime)
-		log.Printf("[INFO] Successfully processed %s as %s in %v", file, size, duration)
+// imageOptions holds the settings for processing one input at one size.
+type imageOptions struct {
+	Size          string
+	Dimension     string
+	AddWatermark  bool
+	Opacity       *float64          // watermark opacity override, nil uses WATERMARK_OPACITY
+	Formats       []string          // extra formats written next to the output
+	Quality       int               // JPEG quality override, 0 uses JPEG_QUALITY
+	AutoFormat    bool              // keep only the smallest of the auto formats
+	KeepAll       bool              // with AutoFormat, keep every encoding
+	Page          int               // 1-based page for multi-page input, 0 for the default
+	Graphic       bool              // input is a graphic (PNG, GIF, SVG) rather than a photo
+	Focal         *focalPoint       // point crops are centered on, nil for none
+	Filter        string            // resampling filter override, "" uses RESIZE_FILTER
+	NoOrient      bool              // ignore the EXIF orientation tag
+	Rotate        int               // clockwise rotation of the source in degrees
+	Flip          string            // flip of the source: "", "h" or "v"
+	Crop          image.Rectangle   // source region kept before resizing, empty for all
+	Watermark     map[string]string // per-file watermark FILE and TEXT replacing the configured one, nil for none
+	TranscodeFrom string            // JPEG input with the same pixels as the output, for lossless JXL
+	StripMetadata bool              // strip metadata from every size, from -strip-metadata
+	Meta          []string          // TAG=VALUE metadata written into every output, from -meta
+	Source        *sourceCache      // decoded input shared by the sizes of one file, nil to decode every time
+}
+
+// processImage resizes inputFile and saves it as outputFile plus one copy per
+// extra format. It returns the files that were written, even on error.
+func processImage(inputFile, outputFile string, opts imageOptions) ([]string, error) {
+	size := opts.Size
+	dim, err := parseDimension(opts.Dimension)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dimension: %w", err)
+	}
+	mode, dim := resolveResize(dim, size)
 
-		if err := changeOwnership(outputFile, ownerUser); err != nil {
-			log.Printf("[ERROR] Failed to change ownership for %s: %v", outputFile, err)
+	if pages := tiffPageCount(inputFile); pages > 1 {
+		if opts.Page == 0 {
+			return processPages(inputFile, outputFile, pages, opts)
 		}
+		if opts.Page > pages {
+			return nil, fmt.Errorf("page %d out of range, %s has %d pages", opts.Page, inputFile, pages)
+		}
+		outputFile = pageFile(outputFile, opts.Page)
+	}
+
+	if isAnimatedGIF(inputFile) {
+		if opts.AddWatermark {
+			log.Printf("[WARNING] Watermarks are not applied to animated GIFs: %s", inputFile)
+		}
+		if opts.Rotate != 0 || opts.Flip != "" || !opts.Crop.Empty() {
+			log.Printf("[WARNING] Rotation, flipping and cropping are not applied to animated GIFs: %s", inputFile)
+		}
+		if mode == "fill" || mode == "pad" {
+			log.Printf("[WARNING] RESIZE_MODE=%s is not applied to animated GIFs, which are fitted instead: %s", mode, inputFile)
+		}
+		return processAnimatedGIF(inputFile, outputFile, dim, opts)
 	}
-}
 
-func processImage(inputFile, watermarkFile, outputFile, dimension, size string, addWatermark bool) error {
-	srcImage, err := imaging.Open(inputFile)
+	keepDepth, err := getSizeEnvBool("KEEP_BIT_DEPTH", size, false)
 	if err != nil {
-		return fmt.Errorf("failed to open input image: %w", err)
+		return nil, err
+	}
+	if keepDepth && isHighBitDepth(inputFile) {
+		if opts.AddWatermark || len(opts.Formats) > 0 || opts.AutoFormat {
+			log.Printf("[WARNING] Watermarks and extra formats are not applied to 16-bit output: %s", inputFile)
+		}
+		if mode == "fill" || mode == "pad" {
+			log.Printf("[WARNING] RESIZE_MODE=%s is not applied to 16-bit output, which is fitted instead: %s", mode, inputFile)
+		}
+		return processDeepImage(inputFile, outputFile, dim, opts)
 	}
 
-	dim, err := strconv.Atoi(dimension)
+	decodeOpts := decodeOptions{Width: dim.Width, Height: dim.Height, Page: opts.Page, NoOrient: opts.NoOrient}
+	if opts.Rotate == 90 || opts.Rotate == 270 {
+		// Render vector and document input at the size it has once rotated.
+		decodeOpts.Width, decodeOpts.Height = dim.Height, dim.Width
+	}
+	if !opts.Crop.Empty() {
+		// Crop coordinates refer to the natural size of rendered input.
+		decodeOpts.Width, decodeOpts.Height = 0, 0
+	}
+	srcImage, err := opts.Source.open(inputFile, decodeOpts)
 	if err != nil {
-		return fmt.Errorf("invalid dimension: %w", err)
+		return nil, fmt.Errorf("failed to open input image: %w", err)
+	}
+	transformed := opts.Rotate != 0 || opts.Flip != ""
+	if transformed {
+		srcImage = transformImage(srcImage, opts)
+	}
+	if !opts.Crop.Empty() {
+		if srcImage, err = cropImage(srcImage, opts.Crop); err != nil {
+			return nil, err
+		}
+		transformed = true
 	}
 
-	dstImage := imaging.Resize(srcImage, dim, 0, imaging.Lanczos)
+	if dim, err = limitUpscale(dim, mode, srcImage.Bounds(), size); err != nil {
+		return nil, err
+	}
+	dstImage, err := resizeImage(srcImage, dim, mode, opts)
+	if err != nil {
+		return nil, err
+	}
+	if isJPEG(inputFile) && !transformed && dstImage.Bounds().Size() == srcImage.Bounds().Size() {
+		opts.TranscodeFrom = inputFile
+	}
 
-	if addWatermark && (size == "xl" || size == "l" || size == "m") {
-		watermark, err := imaging.Open(watermarkFile)
-		if err != nil {
-			return fmt.Errorf("failed to open watermark image: %w", err)
+	adjusted, err := adjustImage(dstImage, size)
+	if err != nil {
+		return nil, err
+	}
+	if adjusted != dstImage {
+		dstImage = adjusted
+		opts.TranscodeFrom = ""
+	}
+
+	watermarked, err := watermarkEnabled(size, dstImage.Bounds().Dx())
+	if err != nil {
+		return nil, err
+	}
+	if opts.AddWatermark && watermarked {
+		if dstImage, err = applyWatermark(dstImage, inputFile, opts); err != nil {
+			return nil, err
 		}
+		opts.TranscodeFrom = ""
+	}
 
-		scaleFactor := getWatermarkScaleFactor(size)
-		resizedWatermark := imaging.Resize(watermark, watermark.Bounds().Dx()*scaleFactor/100, 0, imaging.Lanczos)
-		dstImage = imaging.OverlayCenter(dstImage, resizedWatermark, 1.0)
+	finished, err := maskImage(dstImage, size)
+	if err != nil {
+		return nil, err
+	}
+	finished, err = borderImage(finished, size)
+	if err != nil {
+		return nil, err
+	}
+	finished, err = embedInvisibleWatermark(finished, inputFile, size)
+	if err != nil {
+		return nil, err
+	}
+	if finished != dstImage {
+		dstImage = finished
+		opts.TranscodeFrom = ""
 	}
 
-	if err := imaging.Save(dstImage, outputFile); err != nil {
-		return fmt.Errorf("failed to save output image: %w", err)
+	if opts.AutoFormat {
+		return saveSmallest(dstImage, outputFile, opts)
 	}
 
-	log.Printf("[INFO] Image saved: %s", outputFile)
-	return nil
+	if err := saveImage(dstImage, outputFile, opts); err != nil {
+		return nil, fmt.Errorf("failed to save output image: %w", err)
+	}
+	log.Printf("[INFO] Image saved: %s", finalName(outputFile))
+	written := []string{outputFile}
+
+	for _, format := range opts.Formats {
+		formatFile := withExt(outputFile, format)
+		if formatFile == outputFile {
+			continue
+		}
+		if err := saveImage(dstImage, formatFile, opts); err != nil {
+			return written, fmt.Errorf("failed to save %s output image: %w", format, err)
+		}
+		log.Printf("[INFO] Image saved: %s", finalName(formatFile))
+		written = append(written, formatFile)
+	}
+
+	return written, nil
+}
+
+// processPages processes every page of a multi-page input into its own
+// suffixed output.
+func processPages(inputFile, outputFile string, pages int, opts imageOptions) ([]string, error) {
+	var written []string
+	for page := 1; page <= pages; page++ {
+		opts.Page = page
+		files, err := processImage(inputFile, outputFile, opts)
+		written = append(written, files...)
+		if err != nil {
+			return written, fmt.Errorf("page %d: %w", page, err)
+		}
+	}
+	return written, nil
 }
 
 func isImage(file string) bool {
+	if isRaw(file) {
+		return true
+	}
 	cmd := exec.Command("file", "--mime-type", "-b", file)
 	output, err := cmd.Output()
 	if err != nil {
 		log.Fatalf("[ERROR] Failed to determine file type: %v", err)
 	}
-	return strings.Contains(string(output), "image")
-}
-
-func getWatermarkScaleFactor(size string) int {
-	switch size {
-	case "l":
-		return 66
-	case "m":
-		return 33
-	default:
-		return 100
-	}
+	return strings.Contains(string(output), "image") || strings.Contains(string(output), "application/pdf")
 }
 
 func changeOwnership(file, ownerUser string) error {
+	if ownerUser == "" {
+		return nil
+	}
 	cmd := exec.Command("chown", fmt.Sprintf("%s:%s", ownerUser, ownerUser), file)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -167,11 +1033,47 @@ func changeOwnership(file, ownerUser string) error {
 	return nil
 }
 
-func getEnvOrFail(key string) string {
-	value, exists := os.LookupEnv(key)
-	if !exists || value == "" {
-		log.Fatalf("[ERROR] Environment variable %s is not set. Exiting.", key)
+// getSizeEnv returns the size-specific value of key (e.g. WEBP_QUALITY_S),
+// falling back to the shared key when no override is set.
+func getSizeEnv(key, size string) string {
+	if value := os.Getenv(key + "_" + strings.ToUpper(size)); value != "" {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+func getSizeEnvInt(key, size string, fallback int) (int, error) {
+	value := getSizeEnv(key, size)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func getSizeEnvBool(key, size string, fallback bool) (bool, error) {
+	value := getSizeEnv(key, size)
+	if value == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return b, nil
+}
+
+func getSizeEnvFloat(key, size string, fallback float64) (float64, error) {
+	value := getSizeEnv(key, size)
+	if value == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", key, err)
 	}
-	log.Printf("[INFO] Loaded environment variable: %s=%s", key, value)
-	return value
+	return f, nil
 }
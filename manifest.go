@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	_ "golang.org/x/image/webp" // dimensions of WebP outputs
+)
+
+// runManifest lists the outputs generated by a run, for systems that ingest
+// the results. It is safe for concurrent use.
+type runManifest struct {
+	path    string
+	mu      sync.Mutex
+	entries []manifestEntry
+}
+
+type manifestEntry struct {
+	Input      string `json:"input"`
+	Size       string `json:"size"`
+	Path       string `json:"path"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Bytes      int64  `json:"bytes"`
+	Format     string `json:"format"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// record adds the outputs written for one input and size.
+func (m *runManifest) record(entries []manifestEntry) {
+	m.mu.Lock()
+	m.entries = append(m.entries, entries...)
+	m.mu.Unlock()
+}
+
+// describeOutputs returns the entries of the outputs written for input at
+// size in duration. Formats Go cannot decode, such as AVIF and JPEG XL, take
+// the dimensions of the other outputs of the size, which have the same
+// pixels. Format manifests are left out.
+func describeOutputs(input, size string, written []string, duration time.Duration) []manifestEntry {
+	var entries []manifestEntry
+	var width, height int
+	for _, file := range written {
+		if strings.HasSuffix(file, ".formats.json") {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		entry := manifestEntry{
+			Input:      input,
+			Size:       size,
+			Path:       file,
+			Bytes:      info.Size(),
+			Format:     strings.ToLower(strings.TrimPrefix(filepath.Ext(file), ".")),
+			DurationMs: duration.Milliseconds(),
+		}
+		if config, err := decodeConfig(file); err == nil {
+			entry.Width, entry.Height = config.Width, config.Height
+			width, height = config.Width, config.Height
+		}
+		entries = append(entries, entry)
+	}
+	for i := range entries {
+		if entries[i].Width == 0 {
+			entries[i].Width, entries[i].Height = width, height
+		}
+	}
+	return entries
+}
+
+// decodeConfig returns the dimensions of the image file.
+func decodeConfig(file string) (image.Config, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	return config, err
+}
+
+// save writes the manifest, replacing the file at path.
+func (m *runManifest) save() error {
+	m.mu.Lock()
+	entries := m.entries
+	if entries == nil {
+		entries = []manifestEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	m.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for manifest: %w", err)
+	}
+	if err := os.WriteFile(m.path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// DefaultMaskRadius is the corner radius of MASK=round, as a percentage of
+// the shorter side.
+const DefaultMaskRadius = "10%"
+
+// maskImage cuts the size's MASK shape out of img and makes the rest
+// transparent:
+//
+//	round   rounded corners with MASK_RADIUS (pixels or a percentage of the
+//	        shorter side)
+//	circle  the largest centered circle; the image is cropped to its square
+//
+// Edges are anti-aliased. The transparency is only kept by formats with an
+// alpha channel; JPEG output flattens it onto FLATTEN_COLOR.
+func maskImage(img image.Image, size string) (image.Image, error) {
+	var radius float64
+	switch mask := getSizeEnv("MASK", size); mask {
+	case "", "none":
+		return img, nil
+	case "round":
+		value := getSizeEnv("MASK_RADIUS", size)
+		if value == "" {
+			value = DefaultMaskRadius
+		}
+		bounds := img.Bounds()
+		var err error
+		if radius, err = parseLength(value, min(bounds.Dx(), bounds.Dy())); err != nil {
+			return nil, fmt.Errorf("invalid value for MASK_RADIUS: %w", err)
+		}
+	case "circle":
+		side := min(img.Bounds().Dx(), img.Bounds().Dy())
+		img = imaging.CropCenter(img, side, side)
+		radius = float64(side) / 2
+	default:
+		return nil, fmt.Errorf("invalid value for MASK: %q", mask)
+	}
+
+	dst := imaging.Clone(img)
+	w, h := dst.Bounds().Dx(), dst.Bounds().Dy()
+	radius = min(radius, float64(w)/2, float64(h)/2)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			coverage := cornerCoverage(float64(x)+0.5, float64(y)+0.5, float64(w), float64(h), radius)
+			if coverage >= 1 {
+				continue
+			}
+			i := dst.PixOffset(x, y) + 3
+			dst.Pix[i] = uint8(float64(dst.Pix[i])*coverage + 0.5)
+		}
+	}
+	return dst, nil
+}
+
+// cornerCoverage returns how much of the pixel centered at (x, y) lies inside
+// a w x h rectangle with corners rounded by radius, between 0 and 1.
+func cornerCoverage(x, y, w, h, radius float64) float64 {
+	cx := math.Max(radius, math.Min(x, w-radius))
+	cy := math.Max(radius, math.Min(y, h-radius))
+	if cx == x && cy == y {
+		return 1
+	}
+	d := math.Hypot(x-cx, y-cy)
+	return math.Max(0, math.Min(1, radius-d+0.5))
+}
+
+// parseLength parses a length in pixels ("12") or as a percentage of base
+// ("10%").
+func parseLength(value string, base int) (float64, error) {
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 {
+			return 0, fmt.Errorf("invalid length %q", value)
+		}
+		return float64(base) * p / 100, nil
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid length %q", value)
+	}
+	return n, nil
+}
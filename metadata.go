@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metadataGroups maps the groups of METADATA_COPY to the tags they copy.
+// Orientation is never copied: outputs are rotated upright already.
+var metadataGroups = map[string][]string{
+	"camera":    {"Make", "Model", "LensMake", "LensModel"},
+	"exposure":  {"ExposureTime", "FNumber", "ISO", "FocalLength", "FocalLengthIn35mmFormat", "ExposureProgram", "ExposureMode", "ExposureCompensation", "MeteringMode", "Flash", "WhiteBalance"},
+	"copyright": {"Copyright", "Artist"},
+	"date":      {"DateTimeOriginal", "CreateDate", "OffsetTimeOriginal"},
+}
+
+// exifFormats are the output extensions that the tags of METADATA_COPY are
+// written to.
+var exifFormats = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".webp": true, ".tif": true, ".tiff": true}
+
+// creditFields maps the IPTC_* keys to the IPTC and XMP tags they are
+// written to. IPTC has no field for usage terms.
+var creditFields = []struct {
+	key       string
+	iptc, xmp string
+}{
+	{"IPTC_CREATOR", "IPTC:By-line", "XMP-dc:Creator"},
+	{"IPTC_COPYRIGHT", "IPTC:CopyrightNotice", "XMP-dc:Rights"},
+	{"IPTC_CREDIT", "IPTC:Credit", "XMP-photoshop:Credit"},
+	{"IPTC_USAGE_TERMS", "", "XMP-xmpRights:UsageTerms"},
+}
+
+// iptcFormats are the output extensions that IPTC can be written to; the
+// other formats of exifFormats get XMP only.
+var iptcFormats = map[string]bool{".jpg": true, ".jpeg": true, ".tif": true, ".tiff": true}
+
+// metaTagPattern matches the tag names accepted by -meta, optionally with
+// an exiftool group such as XMP-dc:Creator.
+var metaTagPattern = regexp.MustCompile(`^([A-Za-z0-9-]+:)?[A-Za-z][A-Za-z0-9_-]*$`)
+
+// validMetaTag checks the TAG of a -meta TAG=VALUE flag.
+func validMetaTag(kv string) error {
+	tag, _, _ := strings.Cut(kv, "=")
+	if !metaTagPattern.MatchString(strings.TrimSpace(tag)) {
+		return fmt.Errorf("%q is not a tag name", tag)
+	}
+	return nil
+}
+
+// warnNoExiftool logs once that default metadata stripping is skipped.
+var warnNoExiftool sync.Once
+
+// Modes of STRIP_METADATA: keep what the encoder wrote, remove everything
+// but the ICC profile, or keep the input's metadata without location.
+const (
+	stripNone = "none"
+	stripAll  = "all"
+	stripGPS  = "gps"
+)
+
+// locationTags are the tags removed by STRIP_METADATA=gps: the GPS block and
+// the location fields of XMP and IPTC.
+var locationTags = []string{
+	"gps:all", "xmp:GPS*", "xmp:Location*", "xmp:City", "xmp:State", "xmp:Country*",
+	"iptc:City", "iptc:Sub-location", "iptc:Province-State", "iptc:Country-PrimaryLocation*",
+}
+
+// stripMode returns how the metadata of size's outputs is stripped and
+// whether that was asked for explicitly, by -strip-metadata (force) or
+// STRIP_METADATA: a boolean, or gps. By default, every size except xl, which
+// is usually handed to photographers, is stripped.
+func stripMode(size string, force bool) (mode string, explicit bool, err error) {
+	if force {
+		return stripAll, true, nil
+	}
+	value := getSizeEnv("STRIP_METADATA", size)
+	switch {
+	case value == "" && size == "xl":
+		return stripNone, false, nil
+	case value == "":
+		return stripAll, false, nil
+	case strings.EqualFold(value, stripGPS):
+		return stripGPS, true, nil
+	}
+	strip, err := strconv.ParseBool(value)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid value for STRIP_METADATA: %q is not a boolean or gps", value)
+	}
+	if strip {
+		return stripAll, true, nil
+	}
+	return stripNone, true, nil
+}
+
+// copyTags returns the tags of the METADATA_COPY groups of size, a comma
+// separated list of camera, exposure, copyright and date, or all of them.
+func copyTags(size string) ([]string, error) {
+	var tags []string
+	for _, group := range strings.Split(getSizeEnv("METADATA_COPY", size), ",") {
+		switch group = strings.ToLower(strings.TrimSpace(group)); group {
+		case "":
+		case "all":
+			for _, name := range []string{"camera", "exposure", "copyright", "date"} {
+				tags = append(tags, metadataGroups[name]...)
+			}
+		default:
+			groupTags, ok := metadataGroups[group]
+			if !ok {
+				return nil, fmt.Errorf("invalid value for METADATA_COPY: %q is not camera, exposure, copyright, date or all", group)
+			}
+			tags = append(tags, groupTags...)
+		}
+	}
+	return tags, nil
+}
+
+// creditArgs returns the exiftool assignments of the IPTC_* fields of size
+// for the outputs of file, with the watermark text variables filled in. The
+// IPTC tags are left out unless iptc is set.
+func creditArgs(file, size string, iptc bool) []string {
+	var args []string
+	for _, field := range creditFields {
+		template := getSizeEnv(field.key, size)
+		if template == "" {
+			continue
+		}
+		value := expandWatermarkText(template, file)
+		if iptc && field.iptc != "" {
+			args = append(args, "-"+field.iptc+"="+value)
+		}
+		args = append(args, "-"+field.xmp+"="+value)
+	}
+	if iptc && len(args) > 0 {
+		args = append(args, "-IPTC:CodedCharacterSet=UTF8")
+	}
+	return args
+}
+
+// finishMetadata updates the metadata of the written outputs of file for
+// opts.Size with exiftool. STRIP_METADATA=true removes EXIF (including GPS
+// and maker notes), XMP, IPTC and comments: most encoders drop metadata
+// anyway, but some outputs carry the input's, such as 16-bit outputs and
+// losslessly transcoded JPEG XL. The ICC profile is kept, so colors do not
+// change. STRIP_METADATA=gps instead copies the input's metadata and removes
+// its location. Afterwards, the METADATA_COPY tags are copied from the input,
+// even to stripped outputs, and finally the IPTC_* fields and the -meta tags
+// of opts.Meta are written.
+// Without exiftool an explicit request fails and the default is skipped with
+// a warning.
+func finishMetadata(file string, written []string, opts imageOptions) error {
+	mode, explicit, err := stripMode(opts.Size, opts.StripMetadata)
+	if err != nil {
+		return err
+	}
+	tags, err := copyTags(opts.Size)
+	if err != nil {
+		return err
+	}
+	var outputs, tagged []string
+	for _, output := range written {
+		if strings.HasSuffix(output, ".formats.json") {
+			continue
+		}
+		outputs = append(outputs, output)
+		if exifFormats[strings.ToLower(filepath.Ext(output))] {
+			tagged = append(tagged, output)
+		}
+	}
+	if len(outputs) == 0 {
+		return nil
+	}
+
+	var commands [][]string
+	switch mode {
+	case stripAll:
+		commands = append(commands, append([]string{"-all=", "-tagsFromFile", "@", "-icc_profile"}, outputs...))
+	case stripGPS:
+		if len(tagged) > 0 {
+			// The orientation, dimensions and thumbnails of the input do not
+			// describe the output, nor does its ICC profile after conversions.
+			args := []string{"-tagsFromFile", file, "-all:all", "--Orientation", "--ExifImageWidth", "--ExifImageHeight", "--ThumbnailImage", "--PreviewImage", "--icc_profile:all"}
+			commands = append(commands, append(args, tagged...))
+		}
+		var args []string
+		for _, tag := range locationTags {
+			args = append(args, "-"+tag+"=")
+		}
+		commands = append(commands, append(args, outputs...))
+	}
+	embed := false
+	if mode, _ := colorProfileMode(); mode == profileEmbed && len(tagged) > 0 && isWideGamut(iccProfile(file)) {
+		commands = append(commands, append([]string{"-tagsFromFile", file, "-icc_profile"}, tagged...))
+		embed = true
+	}
+	if len(tags) > 0 && len(tagged) > 0 {
+		args := []string{"-tagsFromFile", file}
+		for _, tag := range tags {
+			args = append(args, "-"+tag)
+		}
+		commands = append(commands, append(args, tagged...))
+	}
+	var iptcOutputs, xmpOutputs []string
+	for _, output := range tagged {
+		if iptcFormats[strings.ToLower(filepath.Ext(output))] {
+			iptcOutputs = append(iptcOutputs, output)
+		} else {
+			xmpOutputs = append(xmpOutputs, output)
+		}
+	}
+	inject := false
+	if args := creditArgs(file, opts.Size, true); len(args) > 0 && len(iptcOutputs) > 0 {
+		commands = append(commands, append(args, iptcOutputs...))
+		inject = true
+	}
+	if args := creditArgs(file, opts.Size, false); len(args) > 0 && len(xmpOutputs) > 0 {
+		commands = append(commands, append(args, xmpOutputs...))
+		inject = true
+	}
+	if len(opts.Meta) > 0 && len(tagged) > 0 {
+		var args []string
+		for _, kv := range opts.Meta {
+			tag, value, _ := strings.Cut(kv, "=")
+			args = append(args, "-"+strings.TrimSpace(tag)+"="+expandWatermarkText(value, file))
+		}
+		commands = append(commands, append(args, tagged...))
+		inject = true
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+
+	if _, err := exec.LookPath("exiftool"); err != nil {
+		if explicit || embed || inject || len(tags) > 0 {
+			return fmt.Errorf("failed to update metadata: %w", err)
+		}
+		warnNoExiftool.Do(func() {
+			log.Printf("[WARNING] exiftool is not installed; outputs are not stripped of metadata (set STRIP_METADATA=false to silence)")
+		})
+		return nil
+	}
+	for _, args := range commands {
+		args = append([]string{"-q", "-overwrite_original"}, args...)
+		if output, err := exec.Command("exiftool", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to update metadata: exiftool failed: %w, output: %s", err, string(output))
+		}
+	}
+	return nil
+}
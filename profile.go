@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Modes of COLOR_PROFILE for inputs with a wide-gamut ICC profile.
+const (
+	profileSRGB   = "srgb"
+	profileEmbed  = "embed"
+	profileIgnore = "ignore"
+)
+
+// maxProfileSize bounds the ICC profiles read, against corrupt lengths.
+const maxProfileSize = 16 << 20
+
+// srgbPrimaries are the D50-adapted red, green and blue colorants (X, Y, Z)
+// of sRGB, as found in the rXYZ, gXYZ and bXYZ tags of sRGB profiles.
+var srgbPrimaries = [3][3]float64{
+	{0.4361, 0.2225, 0.0139},
+	{0.3851, 0.7169, 0.0971},
+	{0.1431, 0.0606, 0.7141},
+}
+
+// colorProfileMode returns COLOR_PROFILE: srgb (default) converts the pixels
+// of wide-gamut input to sRGB, embed keeps them and embeds the input's
+// profile in the outputs, and ignore drops the profile.
+func colorProfileMode() (string, error) {
+	switch mode := strings.ToLower(os.Getenv("COLOR_PROFILE")); mode {
+	case "":
+		return profileSRGB, nil
+	case profileSRGB, profileEmbed, profileIgnore:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid value for COLOR_PROFILE: %q is not srgb, embed or ignore", os.Getenv("COLOR_PROFILE"))
+}
+
+// openProfiled decodes a bitmap file with imaging. Under COLOR_PROFILE=srgb,
+// a wide-gamut input such as Display P3 or Adobe RGB is converted to sRGB by
+// ImageMagick first, with SRGB_PROFILE as the target, so its colors do not
+// come out desaturated.
+func openProfiled(file string, opts decodeOptions) (image.Image, error) {
+	if mode, _ := colorProfileMode(); mode == profileSRGB && isWideGamut(iccProfile(file)) {
+		srgbProfile := os.Getenv("SRGB_PROFILE")
+		if srgbProfile == "" {
+			log.Printf("[WARNING] %s has a wide-gamut color profile and SRGB_PROFILE is not set; colors may look desaturated", file)
+		} else {
+			log.Printf("[INFO] Converting %s from its color profile to sRGB", file)
+			return convertProfile(file, srgbProfile, opts)
+		}
+	}
+	return imaging.Open(file, imaging.AutoOrientation(!opts.NoOrient))
+}
+
+// convertProfile converts file from its embedded profile to srgbProfile with
+// ImageMagick and decodes the result.
+func convertProfile(file, srgbProfile string, opts decodeOptions) (image.Image, error) {
+	tmp, err := os.CreateTemp("", "go-scale-*.png")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpFile := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpFile)
+
+	args := []string{file}
+	if !opts.NoOrient {
+		args = append(args, "-auto-orient")
+	}
+	args = append(args, "-profile", srgbProfile, tmpFile)
+	if output, err := exec.Command("convert", args...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("convert failed: %w, output: %s", err, string(output))
+	}
+	return imaging.Open(tmpFile)
+}
+
+// isWideGamut reports whether profile is an RGB profile whose primaries are
+// not those of sRGB. Profiles without primaries, such as LUT-based ones,
+// count as wide gamut; converting sRGB to sRGB does no harm.
+func isWideGamut(profile []byte) bool {
+	if len(profile) < 132 || string(profile[16:20]) != "RGB " {
+		return false
+	}
+	count := int(binary.BigEndian.Uint32(profile[128:132]))
+	primaries := map[string]int{"rXYZ": 0, "gXYZ": 1, "bXYZ": 2}
+	found := 0
+	for i := 0; i < count && 132+12*(i+1) <= len(profile); i++ {
+		entry := profile[132+12*i:]
+		primary, ok := primaries[string(entry[:4])]
+		if !ok {
+			continue
+		}
+		offset := int(binary.BigEndian.Uint32(entry[4:8]))
+		if offset+20 > len(profile) || string(profile[offset:offset+4]) != "XYZ " {
+			return true
+		}
+		for j := 0; j < 3; j++ {
+			value := float64(int32(binary.BigEndian.Uint32(profile[offset+8+4*j:]))) / 65536
+			if math.Abs(value-srgbPrimaries[primary][j]) > 0.01 {
+				return true
+			}
+		}
+		found++
+	}
+	return found < 3
+}
+
+// iccProfile returns the ICC profile embedded in a JPEG, PNG, WebP or TIFF
+// file, or nil if there is none or the format is not one of these.
+func iccProfile(file string) []byte {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".jpg", ".jpeg":
+		return jpegProfile(f)
+	case ".png":
+		return pngProfile(f)
+	case ".webp":
+		return webpProfile(f)
+	case ".tif", ".tiff":
+		return tiffProfile(f)
+	}
+	return nil
+}
+
+// jpegProfile joins the ICC_PROFILE chunks of the APP2 segments of a JPEG.
+func jpegProfile(r io.Reader) []byte {
+	marker := make([]byte, 4)
+	if _, err := io.ReadFull(r, marker[:2]); err != nil || marker[0] != 0xFF || marker[1] != 0xD8 {
+		return nil
+	}
+	chunks := map[byte][]byte{}
+	for {
+		if _, err := io.ReadFull(r, marker); err != nil || marker[0] != 0xFF {
+			break
+		}
+		// Stop at the start of scan or end of image.
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:4])) - 2
+		if length < 0 {
+			break
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+		if marker[1] == 0xE2 && len(data) > 14 && string(data[:12]) == "ICC_PROFILE\x00" {
+			chunks[data[12]] = data[14:]
+		}
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+	order := make([]int, 0, len(chunks))
+	for seq := range chunks {
+		order = append(order, int(seq))
+	}
+	sort.Ints(order)
+	var profile []byte
+	for _, seq := range order {
+		profile = append(profile, chunks[byte(seq)]...)
+	}
+	return profile
+}
+
+// pngProfile decompresses the iCCP chunk of a PNG.
+func pngProfile(r io.Reader) []byte {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != "\x89PNG\r\n\x1a\n" {
+		return nil
+	}
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		if length > maxProfileSize {
+			return nil
+		}
+		switch string(header[4:8]) {
+		case "iCCP":
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil
+			}
+			// Profile name, NUL, compression method, zlib stream.
+			name := bytes.IndexByte(data, 0)
+			if name < 0 || name+2 > len(data) {
+				return nil
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(data[name+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := io.ReadAll(zr)
+			if err != nil {
+				return nil
+			}
+			return profile
+		case "IDAT", "IEND":
+			return nil
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(length)+4); err != nil {
+			return nil
+		}
+	}
+}
+
+// webpProfile returns the ICCP chunk of an extended WebP.
+func webpProfile(r io.Reader) []byte {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+		return nil
+	}
+	for {
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			return nil
+		}
+		length := int64(binary.LittleEndian.Uint32(header[4:8]))
+		if string(header[:4]) == "ICCP" {
+			if length > maxProfileSize {
+				return nil
+			}
+			profile := make([]byte, length)
+			if _, err := io.ReadFull(r, profile); err != nil {
+				return nil
+			}
+			return profile
+		}
+		// Chunks are padded to an even length.
+		if _, err := io.CopyN(io.Discard, r, length+length%2); err != nil {
+			return nil
+		}
+	}
+}
+
+// tiffProfile returns the ICC profile tag (34675) of the first page of a
+// classic TIFF.
+func tiffProfile(f *os.File) []byte {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil
+	}
+	var order binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil
+	}
+	offset := int64(order.Uint32(header[4:8]))
+	buf := make([]byte, 12)
+	if _, err := f.ReadAt(buf[:2], offset); err != nil {
+		return nil
+	}
+	entries := int64(order.Uint16(buf[:2]))
+	for i := int64(0); i < entries; i++ {
+		if _, err := f.ReadAt(buf, offset+2+i*12); err != nil {
+			return nil
+		}
+		if order.Uint16(buf[:2]) != 34675 {
+			continue
+		}
+		length := order.Uint32(buf[4:8])
+		if length > maxProfileSize {
+			return nil
+		}
+		profile := make([]byte, length)
+		if _, err := f.ReadAt(profile, int64(order.Uint32(buf[8:12]))); err != nil {
+			return nil
+		}
+		return profile
+	}
+	return nil
+}
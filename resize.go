@@ -0,0 +1,472 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// dimension is a parsed DIMENSION_* value: "800" for a width, "800x600"
+// for a bounding box or "50%" for a percentage of the source size. A zero
+// Height (or Width) means that side follows the aspect ratio.
+type dimension struct {
+	Width   int
+	Height  int
+	Percent float64
+}
+
+func parseDimension(value string) (dimension, error) {
+	var d dimension
+	if percent, ok := strings.CutSuffix(strings.TrimSpace(value), "%"); ok {
+		var err error
+		if d.Percent, err = strconv.ParseFloat(percent, 64); err != nil {
+			return d, fmt.Errorf("invalid percentage %q: %w", value, err)
+		}
+		if d.Percent <= 0 {
+			return d, fmt.Errorf("percentage %q must be positive", value)
+		}
+		return d, nil
+	}
+
+	width, height, hasHeight := strings.Cut(strings.ToLower(value), "x")
+
+	var err error
+	if d.Width, err = strconv.Atoi(strings.TrimSpace(width)); err != nil {
+		return d, fmt.Errorf("invalid width in %q: %w", value, err)
+	}
+	if hasHeight {
+		if d.Height, err = strconv.Atoi(strings.TrimSpace(height)); err != nil {
+			return d, fmt.Errorf("invalid height in %q: %w", value, err)
+		}
+	}
+	if d.Width <= 0 || d.Height < 0 {
+		return d, fmt.Errorf("dimension %q must be positive", value)
+	}
+	return d, nil
+}
+
+// geometry formats d as an ImageMagick geometry, which fits into the box
+// when both sides are given.
+func (d dimension) geometry() string {
+	switch {
+	case d.Percent > 0:
+		return strconv.FormatFloat(d.Percent, 'f', -1, 64) + "%"
+	case d.Height == 0:
+		return fmt.Sprintf("%dx", d.Width)
+	case d.Width == 0:
+		return fmt.Sprintf("x%d", d.Height)
+	}
+	return fmt.Sprintf("%dx%d", d.Width, d.Height)
+}
+
+// scaleDimension returns the dimension value multiplied by factor, in the
+// same form, e.g. "500x400" times 2 is "1000x800".
+func scaleDimension(value string, factor int) (string, error) {
+	d, err := parseDimension(value)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case d.Percent > 0:
+		return strconv.FormatFloat(d.Percent*float64(factor), 'f', -1, 64) + "%", nil
+	case d.Height == 0:
+		return strconv.Itoa(d.Width * factor), nil
+	}
+	return fmt.Sprintf("%dx%d", d.Width*factor, d.Height*factor), nil
+}
+
+// parseDensities parses a DPR list such as "2,3" or "2x, 3x" into the pixel
+// densities to produce, always starting with 1.
+func parseDensities(value string) ([]int, error) {
+	densities := []int{1}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(item)), "x")
+		if item == "" {
+			continue
+		}
+		density, err := strconv.Atoi(item)
+		if err != nil || density < 1 || density > 4 {
+			return nil, fmt.Errorf("%q is not a density from 1 to 4", item)
+		}
+		if !slices.Contains(densities, density) {
+			densities = append(densities, density)
+		}
+	}
+	return densities, nil
+}
+
+// densityName returns the name of the density variant of name, e.g.
+// photo@2x.jpg.
+func densityName(name string, density int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s@%dx%s", strings.TrimSuffix(name, ext), density, ext)
+}
+
+// scaleFor returns the factor that brings an image of bounds to d.
+func (d dimension) scaleFor(bounds image.Rectangle) float64 {
+	switch {
+	case d.Percent > 0:
+		return d.Percent / 100
+	case d.Height == 0:
+		return float64(d.Width) / float64(bounds.Dx())
+	case d.Width == 0:
+		return float64(d.Height) / float64(bounds.Dy())
+	}
+	return min(float64(d.Width)/float64(bounds.Dx()), float64(d.Height)/float64(bounds.Dy()))
+}
+
+// resolveResize returns the size's RESIZE_MODE for d. The single-value
+// "height" and "longest" modes are returned as "fit" with d rewritten to a
+// width-less or square box, so callers only deal with boxes. Percentages
+// always use the "scale" mode.
+func resolveResize(d dimension, size string) (string, dimension) {
+	if d.Percent > 0 {
+		return "scale", d
+	}
+	switch mode := getSizeEnv("RESIZE_MODE", size); mode {
+	case "":
+		if d.Height > 0 {
+			return "fit", d
+		}
+		return "width", d
+	case "height":
+		return "fit", dimension{Height: d.Width}
+	case "longest":
+		return "fit", dimension{Width: d.Width, Height: d.Width}
+	default:
+		return mode, d
+	}
+}
+
+// resizeImage scales img to d according to mode, as returned by
+// resolveResize:
+//
+//	scale  scale both sides by d.Percent
+//	width  scale to d.Width, the height follows (default without a height)
+//	fit    scale to fit inside d.Width x d.Height (default with a height)
+//	fill   scale to cover d.Width x d.Height and crop the overflow at the
+//	       size's CROP_ANCHOR, where the most detail is for "smart" or
+//	       around detected faces for "face"
+//	pad    scale to fit inside d.Width x d.Height and extend the canvas to
+//	       exactly that size with the size's PAD_COLOR
+//
+// A focal point in opts takes precedence over CROP_ANCHOR.
+func resizeImage(img image.Image, d dimension, mode string, opts imageOptions) (image.Image, error) {
+	size := opts.Size
+	filter, err := resampleFilter(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mode {
+	case "scale":
+		width := int(math.Round(float64(img.Bounds().Dx()) * d.Percent / 100))
+		return imaging.Resize(img, max(width, 1), 0, filter), nil
+	case "width":
+		return imaging.Resize(img, d.Width, 0, filter), nil
+	case "fit":
+		switch {
+		case d.Height == 0:
+			return nil, fmt.Errorf("resize mode %s needs a WIDTHxHEIGHT dimension", mode)
+		case d.Width == 0:
+			return imaging.Resize(img, 0, d.Height, filter), nil
+		}
+		return fitImage(img, d.Width, d.Height, filter), nil
+	case "pad":
+		if d.Height == 0 {
+			return nil, fmt.Errorf("resize mode %s needs a WIDTHxHEIGHT dimension", mode)
+		}
+		padColor := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+		if value := getSizeEnv("PAD_COLOR", size); value != "" {
+			if padColor, err = parseColor(value); err != nil {
+				return nil, fmt.Errorf("invalid value for PAD_COLOR: %w", err)
+			}
+		}
+		// The canvas keeps its size under UPSCALE=cap; only the image
+		// itself is not enlarged.
+		fitted := imaging.Fit(img, d.Width, d.Height, filter)
+		if policy, _ := upscalePolicy(size); policy == "allow" {
+			fitted = fitImage(img, d.Width, d.Height, filter)
+		}
+		return imaging.PasteCenter(imaging.New(d.Width, d.Height, padColor), fitted), nil
+	case "fill":
+		if d.Height == 0 {
+			return nil, fmt.Errorf("resize mode %s needs a WIDTHxHEIGHT dimension", mode)
+		}
+		if opts.Focal != nil {
+			return fillAround(img, d.Width, d.Height, opts.Focal.in(img.Bounds()), filter), nil
+		}
+		anchorValue := getSizeEnv("CROP_ANCHOR", size)
+		switch anchorValue {
+		case "smart":
+			return smartFill(img, d.Width, d.Height, filter), nil
+		case "face":
+			return faceFill(img, d.Width, d.Height, filter), nil
+		}
+		anchor, err := parseAnchor(anchorValue)
+		if err != nil {
+			return nil, err
+		}
+		return imaging.Fill(img, d.Width, d.Height, anchor, filter), nil
+	default:
+		return nil, fmt.Errorf("invalid value for RESIZE_MODE: %q", mode)
+	}
+}
+
+// fitImage scales img to fit inside width x height. Unlike imaging.Fit it
+// also enlarges images smaller than the box.
+func fitImage(img image.Image, width, height int, filter imaging.ResampleFilter) *image.NRGBA {
+	b := img.Bounds()
+	scale := min(float64(width)/float64(b.Dx()), float64(height)/float64(b.Dy()))
+	return imaging.Resize(img,
+		max(1, int(math.Round(float64(b.Dx())*scale))),
+		max(1, int(math.Round(float64(b.Dy())*scale))),
+		filter)
+}
+
+// resampleFilters maps RESIZE_FILTER values to imaging filters and the
+// matching ImageMagick filter names.
+var resampleFilters = map[string]struct {
+	Filter imaging.ResampleFilter
+	Magick string
+}{
+	"lanczos":    {imaging.Lanczos, "Lanczos"},
+	"catmullrom": {imaging.CatmullRom, "Catrom"},
+	"mitchell":   {imaging.MitchellNetravali, "Mitchell"},
+	"linear":     {imaging.Linear, "Triangle"},
+	"box":        {imaging.Box, "Box"},
+	"nearest":    {imaging.NearestNeighbor, "Point"},
+}
+
+// resampleFilterName returns opts.Filter, or the size's RESIZE_FILTER when
+// no override is given. The default is "lanczos".
+func resampleFilterName(opts imageOptions) (string, error) {
+	name := strings.ToLower(opts.Filter)
+	if name == "" {
+		name = strings.ToLower(getSizeEnv("RESIZE_FILTER", opts.Size))
+	}
+	if name == "" {
+		return "lanczos", nil
+	}
+	if _, ok := resampleFilters[name]; !ok {
+		return "", fmt.Errorf("invalid resize filter %q", name)
+	}
+	return name, nil
+}
+
+func resampleFilter(opts imageOptions) (imaging.ResampleFilter, error) {
+	name, err := resampleFilterName(opts)
+	if err != nil {
+		return imaging.ResampleFilter{}, err
+	}
+	return resampleFilters[name].Filter, nil
+}
+
+// errSkipped marks a size that was deliberately not produced.
+var errSkipped = errors.New("skipped")
+
+// upscalePolicy returns the size's UPSCALE policy: "cap" (the default)
+// limits outputs to the source resolution, "skip" drops sizes larger than
+// the source and "allow" enlarges.
+func upscalePolicy(size string) (string, error) {
+	switch policy := getSizeEnv("UPSCALE", size); policy {
+	case "":
+		return "cap", nil
+	case "cap", "skip", "allow":
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid value for UPSCALE: %q", policy)
+	}
+}
+
+// limitUpscale applies the size's UPSCALE policy to d for a source of the
+// given bounds. Under "cap", d is shrunk by the upscale factor so crops keep
+// their aspect ratio at the source resolution. Under "skip", an error
+// wrapping errSkipped is returned.
+func limitUpscale(d dimension, mode string, bounds image.Rectangle, size string) (dimension, error) {
+	policy, err := upscalePolicy(size)
+	if err != nil {
+		return d, err
+	}
+
+	scale := d.scaleFor(bounds)
+	if mode == "fill" {
+		scale = max(float64(d.Width)/float64(bounds.Dx()), float64(d.Height)/float64(bounds.Dy()))
+	}
+	if scale <= 1 || policy == "allow" || mode == "pad" {
+		return d, nil
+	}
+	if policy == "skip" {
+		return d, fmt.Errorf("%w: source %dx%d is smaller than %s", errSkipped, bounds.Dx(), bounds.Dy(), d.geometry())
+	}
+
+	if d.Percent > 0 {
+		d.Percent = 100
+		return d, nil
+	}
+	d.Width = int(math.Round(float64(d.Width) / scale))
+	d.Height = int(math.Round(float64(d.Height) / scale))
+	return d, nil
+}
+
+// anchors maps CROP_ANCHOR values to imaging anchors.
+var anchors = map[string]imaging.Anchor{
+	"center":       imaging.Center,
+	"top":          imaging.Top,
+	"bottom":       imaging.Bottom,
+	"left":         imaging.Left,
+	"right":        imaging.Right,
+	"top-left":     imaging.TopLeft,
+	"top-right":    imaging.TopRight,
+	"bottom-left":  imaging.BottomLeft,
+	"bottom-right": imaging.BottomRight,
+}
+
+func parseAnchor(value string) (imaging.Anchor, error) {
+	if value == "" {
+		return imaging.Center, nil
+	}
+	anchor, ok := anchors[strings.ToLower(value)]
+	if !ok {
+		return imaging.Center, fmt.Errorf("invalid value for CROP_ANCHOR: %q", value)
+	}
+	return anchor, nil
+}
+
+// coverImage scales img to the smallest size that covers width x height.
+func coverImage(img image.Image, width, height int, filter imaging.ResampleFilter) image.Image {
+	b := img.Bounds()
+	scale := max(float64(width)/float64(b.Dx()), float64(height)/float64(b.Dy()))
+	return imaging.Resize(img,
+		max(width, int(math.Ceil(float64(b.Dx())*scale))),
+		max(height, int(math.Ceil(float64(b.Dy())*scale))),
+		filter)
+}
+
+// smartFill scales img to cover width x height and keeps the window with
+// the most edge energy, so subjects away from the center survive the crop.
+func smartFill(img image.Image, width, height int, filter imaging.ResampleFilter) image.Image {
+	cover := coverImage(img, width, height, filter)
+	gray := imaging.Grayscale(cover)
+	b := gray.Bounds()
+
+	// Only one axis overflows after covering. Sum the gradient magnitude
+	// per column (or row) and slide the crop window along that axis.
+	horizontal := b.Dx() > width
+	n, window := b.Dy(), height
+	if horizontal {
+		n, window = b.Dx(), width
+	}
+	energy := make([]int, n)
+	for y := 1; y < b.Dy(); y++ {
+		for x := 1; x < b.Dx(); x++ {
+			i := gray.PixOffset(x, y)
+			e := absInt(int(gray.Pix[i])-int(gray.Pix[i-4])) + absInt(int(gray.Pix[i])-int(gray.Pix[i-gray.Stride]))
+			if horizontal {
+				energy[x] += e
+			} else {
+				energy[y] += e
+			}
+		}
+	}
+
+	best, bestSum, sum := 0, 0, 0
+	for i := 0; i < n; i++ {
+		sum += energy[i]
+		if i >= window {
+			sum -= energy[i-window]
+		}
+		if i >= window-1 && sum > bestSum {
+			best, bestSum = i-window+1, sum
+		}
+	}
+	if bestSum == 0 {
+		best = (n - window) / 2
+	}
+
+	offset := image.Pt(0, best)
+	if horizontal {
+		offset = image.Pt(best, 0)
+	}
+	return imaging.Crop(cover, image.Rectangle{Min: offset, Max: offset.Add(image.Pt(width, height))})
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// fillAround scales img to cover width x height and crops a window centered
+// as close to center (in img coordinates) as the image edges allow.
+func fillAround(img image.Image, width, height int, center image.Point, filter imaging.ResampleFilter) image.Image {
+	cover := coverImage(img, width, height, filter)
+	scale := float64(cover.Bounds().Dx()) / float64(img.Bounds().Dx())
+	x := int(float64(center.X-img.Bounds().Min.X)*scale) - width/2
+	y := int(float64(center.Y-img.Bounds().Min.Y)*scale) - height/2
+	x = max(0, min(x, cover.Bounds().Dx()-width))
+	y = max(0, min(y, cover.Bounds().Dy()-height))
+	return imaging.Crop(cover, image.Rect(x, y, x+width, y+height))
+}
+
+// faceFill crops around the faces found in img, falling back to smartFill
+// when there are none or detection is unavailable.
+func faceFill(img image.Image, width, height int, filter imaging.ResampleFilter) image.Image {
+	faces, err := detectFaces(img)
+	if err != nil {
+		log.Printf("[WARNING] Face detection failed, using smart crop: %v", err)
+		return smartFill(img, width, height, filter)
+	}
+	if len(faces) == 0 {
+		return smartFill(img, width, height, filter)
+	}
+
+	area := faces[0]
+	for _, face := range faces[1:] {
+		area = area.Union(face)
+	}
+	center := image.Pt((area.Min.X+area.Max.X)/2, (area.Min.Y+area.Max.Y)/2)
+	return fillAround(img, width, height, center.Add(img.Bounds().Min), filter)
+}
+
+// detectFaces runs the facedetect tool on img and returns the face
+// rectangles it reports, one "x y w h" line per face.
+func detectFaces(img image.Image) ([]image.Rectangle, error) {
+	tmpFile, err := writeTempPNG(img)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile)
+
+	output, err := exec.Command("facedetect", tmpFile).Output()
+	if err != nil {
+		// facedetect exits with status 2 when no face was found.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("facedetect failed: %w", err)
+	}
+
+	var faces []image.Rectangle
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		var x, y, w, h int
+		if _, err := fmt.Sscan(line, &x, &y, &w, &h); err != nil {
+			continue
+		}
+		faces = append(faces, image.Rect(x, y, x+w, y+h))
+	}
+	return faces, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// resolveSecrets replaces the values of the settings that refer to a secret
+// store with the secret, so credentials such as those of the upload targets
+// do not have to be stored in plain text:
+//
+//	vault:<path>#<field>  a field of a HashiCorp Vault KV secret (vault CLI)
+//	ssm:<name>            an AWS SSM Parameter Store parameter (aws CLI)
+//
+// The CLIs authenticate as usual, e.g. with VAULT_ADDR and VAULT_TOKEN or the
+// AWS credential chain. Only the keys of settings, those loaded from the
+// .env file and the layers above the exported variables, are resolved, so
+// unrelated variables never reach a secret store.
+func resolveSecrets(settings map[string]string) error {
+	for key := range settings {
+		value := os.Getenv(key)
+		var cmd *exec.Cmd
+		switch {
+		case strings.HasPrefix(value, "vault:"):
+			path, field, ok := strings.Cut(strings.TrimPrefix(value, "vault:"), "#")
+			if !ok || path == "" || field == "" {
+				return fmt.Errorf("invalid value for %s: vault reference must be vault:<path>#<field>", key)
+			}
+			cmd = exec.Command("vault", "kv", "get", "-field="+field, path)
+		case strings.HasPrefix(value, "ssm:"):
+			name := strings.TrimPrefix(value, "ssm:")
+			if name == "" {
+				return fmt.Errorf("invalid value for %s: ssm reference must be ssm:<name>", key)
+			}
+			cmd = exec.Command("aws", "ssm", "get-parameter", "--name", name, "--with-decryption",
+				"--query", "Parameter.Value", "--output", "text")
+		default:
+			continue
+		}
+
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %s failed: %w, output: %s", key, cmd.Args[0], err, stderr.String())
+		}
+		if err := os.Setenv(key, strings.TrimRight(string(output), "\r\n")); err != nil {
+			return fmt.Errorf("failed to set %s: %w", key, err)
+		}
+		log.Printf("[INFO] Resolved %s from %s", key, strings.SplitN(value, ":", 2)[0])
+	}
+	return nil
+}
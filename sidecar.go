@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sidecarSuffix is appended to an input's name to find its sidecar, e.g.
+// photo.jpg.mediascale.yaml.
+const sidecarSuffix = ".mediascale.yaml"
+
+// sidecar holds the per-file overrides read from an input's sidecar.
+type sidecar struct {
+	Crop          image.Rectangle // empty to keep -crop
+	Focal         *focalPoint     // nil to keep -focal or the focal.json sidecar
+	SkipSizes     map[string]bool // sizes not produced for the file
+	Watermark     *bool           // nil to keep -w
+	WatermarkFile string          // relative to the sidecar's directory
+	WatermarkText string
+}
+
+// sidecarFile is the YAML document of a sidecar.
+type sidecarFile struct {
+	Crop          string    `yaml:"crop"`
+	Focal         string    `yaml:"focal"`
+	SkipSizes     sizeNames `yaml:"skip_sizes"`
+	Watermark     *bool     `yaml:"watermark"`
+	WatermarkFile string    `yaml:"watermark_file"`
+	WatermarkText string    `yaml:"watermark_text"`
+}
+
+// sizeNames is a list of sizes, written as a YAML list or as a
+// comma-separated string.
+type sizeNames []string
+
+func (n *sizeNames) UnmarshalYAML(value *yaml.Node) error {
+	var names []string
+	if value.Kind == yaml.SequenceNode {
+		if err := value.Decode(&names); err != nil {
+			return err
+		}
+	} else {
+		var list string
+		if err := value.Decode(&list); err != nil {
+			return err
+		}
+		names = strings.Split(list, ",")
+	}
+	*n = nil
+	for _, name := range names {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			*n = append(*n, name)
+		}
+	}
+	return nil
+}
+
+// loadSidecar reads the sidecar of file, a YAML file such as
+//
+//	crop: 120,0,2400,1600
+//	focal: 0.3,0.6
+//	skip_sizes: [s, xl]
+//	watermark: true
+//	watermark_file: client-logo.png
+//	watermark_text: "© Client {date}"
+//
+// The sizes of skip_sizes are checked against known. It returns nil when
+// there is no sidecar.
+func loadSidecar(file string, known []string) (*sidecar, error) {
+	path := file + sidecarSuffix
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid sidecar %s: %w", path, err)
+	}
+
+	var doc sidecarFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid sidecar %s: %w", path, err)
+	}
+
+	s := sidecar{Watermark: doc.Watermark, WatermarkText: doc.WatermarkText}
+	if doc.Crop != "" {
+		if s.Crop, err = parseCrop(strings.TrimSpace(doc.Crop)); err != nil {
+			return nil, fmt.Errorf("invalid sidecar %s: crop: %w", path, err)
+		}
+	}
+	if doc.Focal != "" {
+		if s.Focal, err = parseFocal(strings.TrimSpace(doc.Focal)); err != nil {
+			return nil, fmt.Errorf("invalid sidecar %s: focal: %w", path, err)
+		}
+	}
+	if len(doc.SkipSizes) > 0 {
+		s.SkipSizes = map[string]bool{}
+		for _, size := range doc.SkipSizes {
+			if !slices.Contains(known, size) {
+				return nil, fmt.Errorf("invalid sidecar %s: skip_sizes: unknown size %q (configured: %s)", path, size, strings.Join(known, ", "))
+			}
+			s.SkipSizes[size] = true
+		}
+	}
+	if value := strings.TrimSpace(doc.WatermarkFile); value != "" {
+		if !filepath.IsAbs(value) {
+			value = filepath.Join(filepath.Dir(file), value)
+		}
+		s.WatermarkFile = value
+	}
+	return &s, nil
+}
+
+// apply merges the sidecar's overrides into opts and sizes, which is
+// replaced rather than modified.
+func (s *sidecar) apply(opts *imageOptions, sizes *map[string]bool) {
+	if !s.Crop.Empty() {
+		opts.Crop = s.Crop
+	}
+	if s.Focal != nil {
+		opts.Focal = s.Focal
+	}
+	if s.Watermark != nil {
+		opts.AddWatermark = *s.Watermark
+	}
+	if s.WatermarkFile != "" || s.WatermarkText != "" {
+		opts.Watermark = map[string]string{"FILE": s.WatermarkFile, "TEXT": s.WatermarkText}
+	}
+	if len(s.SkipSizes) > 0 {
+		remaining := map[string]bool{}
+		for size, enabled := range *sizes {
+			remaining[size] = enabled && !s.SkipSizes[size]
+		}
+		*sizes = remaining
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// builtinSizes are the sizes selected by the -s, -m, -l and -xl flags.
+var builtinSizes = []string{"s", "m", "l", "xl"}
+
+// reservedSizeNames are the names that would make a per-size key read another
+// setting: a size called "file" would read WATERMARK_FILE as its WATERMARK,
+// "radius" MASK_RADIUS as its MASK, and so on.
+var reservedSizeNames = []string{
+	"file", "text", "font", "width", "scale", "mode", "spacing", "position", "margin",
+	"opacity", "rotate", "blend", "layers", "portrait", "landscape", "radius", "strength",
+}
+
+// breakpointSizePattern matches the names of the sizes of -breakpoints, such
+// as w640.
+var breakpointSizePattern = regexp.MustCompile(`^w[0-9]+$`)
+
+// configuredSizes returns the built-in sizes followed by the named sizes
+// listed in SIZES, e.g. SIZES="thumb,hero,og". Named sizes are configured like
+// the built-in ones, with DIMENSION_THUMB, JPEG_QUALITY_HERO and so on.
+func configuredSizes() ([]string, error) {
+	sizes := slices.Clone(builtinSizes)
+	for _, name := range strings.Split(os.Getenv("SIZES"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || slices.Contains(sizes, name) {
+			continue
+		}
+		if !validSizeName(name) {
+			return nil, fmt.Errorf("invalid value for SIZES: size name %q may only contain letters and digits", name)
+		}
+		if name == "favicon" {
+			return nil, fmt.Errorf("invalid value for SIZES: %q is reserved for -favicon", name)
+		}
+		if breakpointSizePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid value for SIZES: %q is reserved for the widths of -breakpoints", name)
+		}
+		if slices.Contains(reservedSizeNames, name) {
+			return nil, fmt.Errorf("invalid value for SIZES: %q is reserved, as its per-size keys would read other settings", name)
+		}
+		sizes = append(sizes, name)
+	}
+	return sizes, nil
+}
+
+// validSizeName reports whether name can be used as a suffix of per-size
+// keys such as DIMENSION_<NAME>.
+func validSizeName(name string) bool {
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSizeList parses a comma-separated list of sizes, such as the -sizes
+// value, checking each against the configured sizes.
+func parseSizeList(value string, known []string) (map[string]bool, error) {
+	sizes := map[string]bool{}
+	for _, name := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		name = strings.ToLower(name)
+		if !slices.Contains(known, name) {
+			return nil, fmt.Errorf("unknown size %q (configured: %s)", name, strings.Join(known, ", "))
+		}
+		sizes[name] = true
+	}
+	return sizes, nil
+}
+
+// defaultSizes returns the sizes selected by DEFAULT_SIZES when no size is
+// given on the command line: a list like -sizes, "all", or "none" (the
+// default) to require an explicit selection.
+func defaultSizes(known []string) (map[string]bool, error) {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("DEFAULT_SIZES")))
+	switch value {
+	case "", "none":
+		return map[string]bool{}, nil
+	case "all":
+		sizes := map[string]bool{}
+		for _, size := range known {
+			sizes[size] = true
+		}
+		return sizes, nil
+	}
+	sizes, err := parseSizeList(value, known)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for DEFAULT_SIZES: %w", err)
+	}
+	return sizes, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// srcsetFormats are the -srcset output kinds.
+var srcsetFormats = []string{"html", "json"}
+
+// fallbackFormats are the formats an <img> can fall back to, most widely
+// supported first. The other formats become <source> elements.
+var fallbackFormats = []string{"jpg", "jpeg", "png", "gif", "webp", "tif", "tiff", "avif", "jxl"}
+
+// sourceFormats orders the <source> elements: browsers use the first type
+// they support, so the most efficient formats come first.
+var sourceFormats = []string{"jxl", "avif", "webp"}
+
+var mimeTypes = map[string]string{
+	"jpg": "image/jpeg", "jpeg": "image/jpeg", "png": "image/png", "gif": "image/gif",
+	"webp": "image/webp", "avif": "image/avif", "jxl": "image/jxl", "tif": "image/tiff", "tiff": "image/tiff",
+}
+
+// pictureSnippet describes the responsive variants of one input.
+type pictureSnippet struct {
+	Input    string          `json:"input"`
+	Sources  []pictureSource `json:"sources"`
+	Fallback pictureImg      `json:"img"`
+}
+
+type pictureSource struct {
+	Type   string `json:"type"`
+	Srcset string `json:"srcset"`
+}
+
+type pictureImg struct {
+	Src    string `json:"src"`
+	Srcset string `json:"srcset"`
+	Sizes  string `json:"sizes"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// buildPicture groups the outputs of input by format into srcsets. URLs are
+// the outputs' paths below baseDir, prefixed with SRCSET_BASE_URL (default
+// "/"). It returns false when there are no outputs.
+func buildPicture(input, baseDir string, entries []manifestEntry) (pictureSnippet, bool) {
+	baseURL := os.Getenv("SRCSET_BASE_URL")
+	if baseURL == "" {
+		baseURL = "/"
+	}
+	sizes := os.Getenv("SRCSET_SIZES")
+	if sizes == "" {
+		sizes = "100vw"
+	}
+
+	byFormat := map[string][]manifestEntry{}
+	for _, entry := range entries {
+		if entry.Width > 0 {
+			byFormat[entry.Format] = append(byFormat[entry.Format], entry)
+		}
+	}
+	fallback := ""
+	for _, format := range fallbackFormats {
+		if len(byFormat[format]) > 0 {
+			fallback = format
+			break
+		}
+	}
+	if fallback == "" {
+		return pictureSnippet{}, false
+	}
+
+	srcset := func(entries []manifestEntry) (string, manifestEntry) {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Width < entries[j].Width })
+		var candidates []string
+		for i, entry := range entries {
+			// Sizes that end up equally wide, e.g. when upscaling is off, are listed once.
+			if i > 0 && entries[i-1].Width == entry.Width {
+				continue
+			}
+			candidates = append(candidates, fmt.Sprintf("%s %dw", outputURL(baseURL, baseDir, entry.Path), entry.Width))
+		}
+		return strings.Join(candidates, ", "), entries[len(entries)-1]
+	}
+
+	snippet := pictureSnippet{Input: input, Sources: []pictureSource{}}
+	formats := make([]string, 0, len(byFormat))
+	for format := range byFormat {
+		if format != fallback {
+			formats = append(formats, format)
+		}
+	}
+	sort.Slice(formats, func(i, j int) bool {
+		a, b := slices.Index(sourceFormats, formats[i]), slices.Index(sourceFormats, formats[j])
+		if a == -1 || b == -1 {
+			return a > b || (a == b && formats[i] < formats[j])
+		}
+		return a < b
+	})
+	for _, format := range formats {
+		set, _ := srcset(byFormat[format])
+		snippet.Sources = append(snippet.Sources, pictureSource{Type: mimeTypes[format], Srcset: set})
+	}
+	set, largest := srcset(byFormat[fallback])
+	snippet.Fallback = pictureImg{
+		Src:    outputURL(baseURL, baseDir, largest.Path),
+		Srcset: set,
+		Sizes:  sizes,
+		Width:  largest.Width,
+		Height: largest.Height,
+	}
+	return snippet, true
+}
+
+// outputURL returns the URL of file below baseDir.
+func outputURL(baseURL, baseDir, file string) string {
+	rel, err := filepath.Rel(baseDir, file)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = file
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/" + strings.TrimPrefix(path.Clean(filepath.ToSlash(rel)), "/")
+}
+
+// html renders the snippet as a <picture> element.
+func (p pictureSnippet) html() string {
+	var b strings.Builder
+	b.WriteString("<picture>\n")
+	for _, source := range p.Sources {
+		fmt.Fprintf(&b, "  <source type=\"%s\" srcset=\"%s\" sizes=\"%s\">\n",
+			html.EscapeString(source.Type), html.EscapeString(source.Srcset), html.EscapeString(p.Fallback.Sizes))
+	}
+	fmt.Fprintf(&b, "  <img src=\"%s\" srcset=\"%s\" sizes=\"%s\" width=\"%d\" height=\"%d\" alt=\"\">\n",
+		html.EscapeString(p.Fallback.Src), html.EscapeString(p.Fallback.Srcset), html.EscapeString(p.Fallback.Sizes),
+		p.Fallback.Width, p.Fallback.Height)
+	b.WriteString("</picture>\n")
+	return b.String()
+}
+
+// writePicture writes the snippet of input to OUTPUT_BASE_DIR/srcset/<dir>/
+// as <stem>.html or <stem>.json, depending on kind, and returns the file.
+func writePicture(snippet pictureSnippet, input inputFile, baseDir, name, kind string) (string, error) {
+	outputDir := filepath.Join(baseDir, "srcset", input.Dir)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory %s: %w", outputDir, err)
+	}
+	file := filepath.Join(outputDir, strings.TrimSuffix(name, filepath.Ext(name))+"."+kind)
+	var data []byte
+	if kind == "json" {
+		var err error
+		if data, err = json.MarshalIndent(snippet, "", "  "); err != nil {
+			return "", fmt.Errorf("failed to encode srcset: %w", err)
+		}
+	} else {
+		data = []byte(snippet.html())
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write srcset: %w", err)
+	}
+	return file, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultStateFile is the incremental state file, relative to OUTPUT_BASE_DIR.
+const DefaultStateFile = ".go-scale-state.json"
+
+// stateDB records, for every input and size, the input modification time and
+// the configuration the outputs were generated with, so that an incremental
+// run only regenerates what changed. It is safe for concurrent use.
+type stateDB struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]stateEntry
+}
+
+type stateEntry struct {
+	ModTime time.Time `json:"mtime"`
+	Config  string    `json:"config"`
+	Output  string    `json:"output"`
+}
+
+// loadState reads the state file at path. A missing file yields an empty
+// state.
+func loadState(path string) (*stateDB, error) {
+	db := &stateDB{path: path, entries: map[string]stateEntry{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &db.entries); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// stateKey identifies input at size in the state file.
+func stateKey(input, size string) string {
+	if abs, err := filepath.Abs(input); err == nil {
+		input = abs
+	}
+	return size + ":" + input
+}
+
+// upToDate reports whether the output recorded for key was generated from
+// the same input modification time and configuration as entry, and still
+// exists.
+func (db *stateDB) upToDate(key string, entry stateEntry) bool {
+	db.mu.Lock()
+	old, ok := db.entries[key]
+	db.mu.Unlock()
+	if !ok || !old.ModTime.Equal(entry.ModTime) || old.Config != entry.Config {
+		return false
+	}
+	_, err := os.Stat(old.Output)
+	return err == nil
+}
+
+func (db *stateDB) record(key string, entry stateEntry) {
+	db.mu.Lock()
+	db.entries[key] = entry
+	db.mu.Unlock()
+}
+
+// save writes the state file, replacing the previous one atomically.
+func (db *stateDB) save() error {
+	db.mu.Lock()
+	data, err := json.MarshalIndent(db.entries, "", "  ")
+	db.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(db.path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for state file: %w", err)
+	}
+	tmpFile := db.path + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmpFile, db.path); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// configKeys are the settings the tool reads, without their size suffix.
+// WATERMARK and IPTC_ also stand for every key starting with them, such as
+// the settings of named watermark layers.
+var configKeys = []string{
+	"AUTO_LEVELS", "AVIF_QUALITY", "AVIF_SPEED", "BORDER_COLOR", "BORDER_WIDTH",
+	"BREAKPOINTS_COUNT", "BREAKPOINTS_MAX", "BREAKPOINTS_MIN", "BRIGHTNESS",
+	"CHROMA_SUBSAMPLING", "CMYK_PROFILE", "COLLISION", "COLOR_FILTER", "COLOR_PROFILE",
+	"CONTRAST", "CROP_ANCHOR", "DEFAULT_SIZES", "DIMENSION", "DPR", "FLATTEN_COLOR",
+	"GAMMA", "GCS_BUCKET", "GCS_CACHE_CONTROL", "GCS_GZIP_MANIFESTS",
+	"GCS_MANIFEST_PREFIX", "GCS_PREFIX", "GCS_STORAGE_CLASS", "HASH_LENGTH",
+	"HASH_NAMES", "INVISIBLE_WATERMARK", "INVISIBLE_WATERMARK_STRENGTH",
+	"JPEG_ENCODER", "JPEG_PROGRESSIVE", "JPEG_QUALITY", "JXL_EFFORT", "JXL_QUALITY",
+	"KEEP_BIT_DEPTH", "MASK", "MASK_RADIUS", "METADATA_COPY", "MOZJPEG_CJPEG",
+	"NAME_MAP_FILE", "OUTPUT_BASE_DIR", "OUTPUT_FORMATS", "OUTPUT_PATH", "OWNER_USER",
+	"PAD_COLOR", "PNG_OPTIMIZE", "PNG_QUANT_QUALITY", "RAW_DECODE", "RESIZE_FILTER",
+	"RESIZE_MODE", "S3_BUCKET", "S3_CACHE_CONTROL", "S3_PREFIX", "S3_STORAGE_CLASS",
+	"SATURATION", "SHARPEN", "SIZES", "SRCSET_BASE_URL", "SRCSET_SIZES",
+	"SRGB_PROFILE", "STATE_FILE", "STRIP_METADATA", "TINT_COLOR", "TINT_STRENGTH",
+	"UPSCALE",
+}
+
+// isConfigKey reports whether key is one of configKeys, possibly for one of
+// sizes, e.g. JPEG_QUALITY_XL.
+func isConfigKey(key string, sizes []string) bool {
+	for _, size := range sizes {
+		if base, ok := strings.CutSuffix(key, "_"+strings.ToUpper(size)); ok {
+			key = base
+			break
+		}
+	}
+	return slices.Contains(configKeys, key) || strings.HasPrefix(key, "WATERMARK") || strings.HasPrefix(key, "IPTC_")
+}
+
+// configHash returns a hash of the settings that shape the outputs of one
+// size: the image options and the effective value of every setting, whether
+// it comes from the .env file, the exported variables or a layer above them,
+// except the ones that only apply to other sizes among sizes. The settings
+// are the keys of configKeys and those of settings, as loaded by loadConfig.
+func configHash(settings map[string]string, sizes []string, opts imageOptions) (string, error) {
+	values := map[string]string{}
+	for key, value := range environ() {
+		if _, ok := settings[key]; !ok && !isConfigKey(key, sizes) {
+			continue
+		}
+		if appliesToOtherSize(key, opts.Size, sizes) {
+			continue
+		}
+		values[key] = value
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s=%s\n", key, values[key])
+	}
+	opts.Source = nil
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode options: %w", err)
+	}
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// appliesToOtherSize reports whether key is a per-size setting, such as
+// JPEG_QUALITY_XL, for one of sizes other than size.
+func appliesToOtherSize(key, size string, sizes []string) bool {
+	for _, other := range sizes {
+		if other != size && strings.HasSuffix(key, "_"+strings.ToUpper(other)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkpoint records the inputs a run has finished, one path per line, so
+// that an interrupted run can resume where it left off. Every line is
+// synced to disk as it is written. It is safe for concurrent use.
+type checkpoint struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+	done map[string]bool
+}
+
+// openCheckpoint opens the checkpoint file at path, reading the inputs that
+// an earlier run already finished.
+func openCheckpoint(path string) (*checkpoint, error) {
+	c := &checkpoint{path: path, done: map[string]bool{}}
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			c.done[scanner.Text()] = true
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read checkpoint file: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read checkpoint file: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint file: %w", err)
+	}
+	c.file = f
+	return c, nil
+}
+
+// pending returns the files the checkpoint does not list as finished.
+func (c *checkpoint) pending(files []inputFile) []inputFile {
+	var remaining []inputFile
+	for _, file := range files {
+		if !c.done[file.Path] {
+			remaining = append(remaining, file)
+		}
+	}
+	return remaining
+}
+
+// markDone records file as finished.
+func (c *checkpoint) markDone(file string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintln(c.file, file); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return c.file.Sync()
+}
+
+// remove deletes the checkpoint file once the run is complete.
+func (c *checkpoint) remove() error {
+	c.file.Close()
+	return os.Remove(c.path)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// stegoBlock is the side of the pixel blocks that carry one payload bit
+	// each. It matches the JPEG block grid, so recompression changes the
+	// block means very little.
+	stegoBlock = 8
+	// DefaultStegoStrength is the quantization step of the block brightness,
+	// the largest change is half of it.
+	DefaultStegoStrength = 8
+	// maxStegoPayload is the longest payload in bytes.
+	maxStegoPayload = 64
+)
+
+// errNoStegoPayload is returned by readInvisibleWatermark when the image
+// carries no readable payload.
+var errNoStegoPayload = errors.New("no invisible watermark found")
+
+// embedInvisibleWatermark hides the size's INVISIBLE_WATERMARK payload (an
+// asset ID for example; the text watermark variables are filled in for
+// inputFile) in img. Every bit sets the average brightness of 8x8 blocks,
+// quantized with steps of INVISIBLE_WATERMARK_STRENGTH, and is repeated over
+// the whole image. The payload survives recompression at reasonable quality
+// but not resizing or cropping.
+func embedInvisibleWatermark(img image.Image, inputFile, size string) (image.Image, error) {
+	template := getSizeEnv("INVISIBLE_WATERMARK", size)
+	if template == "" {
+		return img, nil
+	}
+	payload := expandWatermarkText(template, inputFile)
+	if len(payload) > maxStegoPayload {
+		return nil, fmt.Errorf("invalid value for INVISIBLE_WATERMARK: %q is longer than %d bytes", payload, maxStegoPayload)
+	}
+	strength, err := getSizeEnvInt("INVISIBLE_WATERMARK_STRENGTH", size, DefaultStegoStrength)
+	if err != nil {
+		return nil, err
+	}
+	if strength < 2 {
+		return nil, fmt.Errorf("invalid value for INVISIBLE_WATERMARK_STRENGTH: %d is less than 2", strength)
+	}
+
+	bits := stegoBits([]byte(payload))
+	dst := imaging.Clone(img)
+	blocks := stegoBlocks(dst.Bounds())
+	if len(blocks) < len(bits) {
+		return nil, fmt.Errorf("image is too small for an invisible watermark of %d bytes", len(payload))
+	}
+	step := float64(strength)
+	for i, block := range blocks {
+		mean := blockLuma(dst, block)
+		// Quantize the mean to the lattice of the bit: multiples of step for
+		// 0, multiples shifted by half a step for 1.
+		offset := float64(bits[i%len(bits)]) * step / 2
+		target := math.Round((mean-offset)/step)*step + offset
+		if target < 0 {
+			target += step
+		} else if target > 255 {
+			target -= step
+		}
+		shiftBlock(dst, block, target-mean)
+	}
+	return dst, nil
+}
+
+// readInvisibleWatermark returns the payload embedded by
+// embedInvisibleWatermark with the given strength.
+func readInvisibleWatermark(img image.Image, strength int) (string, error) {
+	src := imaging.Clone(img)
+	blocks := stegoBlocks(src.Bounds())
+	step := float64(strength)
+	read := make([]byte, len(blocks))
+	for i, block := range blocks {
+		// The distance to the nearest multiple of step tells the bit.
+		r := math.Mod(blockLuma(src, block), step)
+		if r > step/4 && r < step*3/4 {
+			read[i] = 1
+		}
+	}
+
+	for n := 0; n <= maxStegoPayload; n++ {
+		total := (n + 5) * 8
+		if total > len(read) {
+			break
+		}
+		votes := make([]int, total)
+		for i, bit := range read {
+			if bit == 1 {
+				votes[i%total]++
+			} else {
+				votes[i%total]--
+			}
+		}
+		frame := make([]byte, n+5)
+		for i, v := range votes {
+			if v > 0 {
+				frame[i/8] |= 1 << (7 - i%8)
+			}
+		}
+		if int(frame[0]) == n && crc32.ChecksumIEEE(frame[:n+1]) == beUint32(frame[n+1:]) {
+			return string(frame[1 : n+1]), nil
+		}
+	}
+	return "", errNoStegoPayload
+}
+
+// stegoBits frames payload as length byte, payload and CRC-32 and returns
+// its bits, most significant first.
+func stegoBits(payload []byte) []byte {
+	frame := append([]byte{byte(len(payload))}, payload...)
+	sum := crc32.ChecksumIEEE(frame)
+	frame = append(frame, byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum))
+	bits := make([]byte, 0, len(frame)*8)
+	for _, b := range frame {
+		for i := 7; i >= 0; i-- {
+			bits = append(bits, b>>i&1)
+		}
+	}
+	return bits
+}
+
+func beUint32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// stegoBlocks returns the complete 8x8 blocks of bounds in raster order.
+func stegoBlocks(bounds image.Rectangle) []image.Rectangle {
+	var blocks []image.Rectangle
+	for y := bounds.Min.Y; y+stegoBlock <= bounds.Max.Y; y += stegoBlock {
+		for x := bounds.Min.X; x+stegoBlock <= bounds.Max.X; x += stegoBlock {
+			blocks = append(blocks, image.Rect(x, y, x+stegoBlock, y+stegoBlock))
+		}
+	}
+	return blocks
+}
+
+// blockLuma returns the average luma of block.
+func blockLuma(img *image.NRGBA, block image.Rectangle) float64 {
+	var sum float64
+	for y := block.Min.Y; y < block.Max.Y; y++ {
+		for x := block.Min.X; x < block.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			sum += 0.299*float64(img.Pix[i]) + 0.587*float64(img.Pix[i+1]) + 0.114*float64(img.Pix[i+2])
+		}
+	}
+	return sum / float64(block.Dx()*block.Dy())
+}
+
+// shiftBlock adds delta to every color channel of block, which changes its
+// luma by delta as long as no channel clips.
+func shiftBlock(img *image.NRGBA, block image.Rectangle, delta float64) {
+	for y := block.Min.Y; y < block.Max.Y; y++ {
+		for x := block.Min.X; x < block.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				img.Pix[i+c] = clampUint8(float64(img.Pix[i+c]) + delta)
+			}
+		}
+	}
+}
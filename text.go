@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+// DefaultWatermarkFontSize is the text watermark's font size, as a
+// percentage of the output height.
+const DefaultWatermarkFontSize = "4%"
+
+// textWatermark renders the layer's _TEXT for inputFile on a transparent
+// background, _FONT_SIZE high (pixels or a percentage of imageHeight) in
+// _TEXT_COLOR (white by default). _FONT points at a TrueType or OpenType
+// font; the Go font is used otherwise.
+func textWatermark(inputFile string, layer watermarkLayer, imageHeight int) (image.Image, error) {
+	text := expandWatermarkText(layer.get("TEXT"), inputFile)
+
+	value := layer.get("FONT_SIZE")
+	if value == "" {
+		value = DefaultWatermarkFontSize
+	}
+	fontSize, err := parseLength(value, imageHeight)
+	if err != nil || fontSize <= 0 {
+		return nil, fmt.Errorf("invalid value for %s: %q", layer.key("FONT_SIZE"), value)
+	}
+
+	textColor := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	if value := layer.get("TEXT_COLOR"); value != "" {
+		if textColor, err = parseColor(value); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", layer.key("TEXT_COLOR"), err)
+		}
+	}
+
+	fontData := goregular.TTF
+	if fontFile := layer.get("FONT"); fontFile != "" {
+		if fontData, err = os.ReadFile(fontFile); err != nil {
+			return nil, fmt.Errorf("failed to read watermark font: %w", err)
+		}
+	}
+	f, err := sfnt.Parse(fontData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse watermark font: %w", err)
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: fontSize, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load watermark font: %w", err)
+	}
+	defer face.Close()
+
+	return renderText(text, face, textColor), nil
+}
+
+// renderText draws a single line of text in face onto a transparent image
+// that fits it exactly.
+func renderText(text string, face font.Face, c color.NRGBA) image.Image {
+	metrics := face.Metrics()
+	width := font.MeasureString(face, text).Ceil()
+	height := (metrics.Ascent + metrics.Descent).Ceil()
+	dst := image.NewNRGBA(image.Rect(0, 0, max(width, 1), max(height, 1)))
+	drawer := font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.Point26_6{Y: metrics.Ascent},
+	}
+	drawer.DrawString(text)
+	return dst
+}
+
+// expandWatermarkText fills in the variables of a watermark text template
+// for inputFile:
+//
+//	{filename}   base name of the input file
+//	{date}       modification date of the input file, YYYY-MM-DD
+//	{copyright}  COPYRIGHT
+//	{user}       OWNER_USER
+func expandWatermarkText(template, inputFile string) string {
+	date := ""
+	if info, err := os.Stat(inputFile); err == nil {
+		date = info.ModTime().Format("2006-01-02")
+	}
+	return strings.NewReplacer(
+		"{filename}", filepath.Base(inputFile),
+		"{date}", date,
+		"{copyright}", os.Getenv("COPYRIGHT"),
+		"{user}", os.Getenv("OWNER_USER"),
+	).Replace(template)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DefaultUploadPrefix is the key prefix of uploaded outputs, which mirrors
+// the default layout below OUTPUT_BASE_DIR.
+const DefaultUploadPrefix = "{size}/{dir}"
+
+// s3StorageClasses are the values accepted for S3_STORAGE_CLASS.
+var s3StorageClasses = []string{
+	"STANDARD", "REDUCED_REDUNDANCY", "STANDARD_IA", "ONEZONE_IA", "INTELLIGENT_TIERING",
+	"GLACIER", "GLACIER_IR", "DEEP_ARCHIVE",
+}
+
+// gcsStorageClasses are the values accepted for GCS_STORAGE_CLASS.
+var gcsStorageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"}
+
+// uploadOutputs uploads the outputs written for input at size to the
+// configured S3 and Google Cloud Storage buckets, if any.
+func uploadOutputs(input inputFile, size string, written []string) error {
+	if err := uploadS3(input, size, written); err != nil {
+		return err
+	}
+	return uploadGCS(input, size, written)
+}
+
+// uploadKey returns the object key of an output file of input at size: the
+// prefix template, with {size}, {dir} and the {year}, {month}, {day}, {hour},
+// {minute} and {second} of the capture date filled in, followed by the file
+// name.
+func uploadKey(prefix string, input inputFile, size, file string) string {
+	prefix = strings.NewReplacer(append([]string{
+		"{size}", size,
+		"{dir}", filepath.ToSlash(input.Dir),
+	}, dateReplacements(input.Taken)...)...).Replace(prefix)
+	return strings.TrimPrefix(path.Join(prefix, filepath.Base(file)), "/")
+}
+
+// checkS3Settings checks the S3 settings of size, if it is uploaded.
+func checkS3Settings(size string) error {
+	bucket := getSizeEnv("S3_BUCKET", size)
+	if bucket == "" {
+		return nil
+	}
+	if strings.Contains(bucket, "/") || strings.HasPrefix(bucket, "s3:") {
+		return fmt.Errorf("invalid value for S3_BUCKET: %q is not a bucket name; put the path in S3_PREFIX", bucket)
+	}
+	if class := getSizeEnv("S3_STORAGE_CLASS", size); class != "" && !slices.Contains(s3StorageClasses, class) {
+		return fmt.Errorf("invalid value for S3_STORAGE_CLASS: %q is not one of %s", class, strings.Join(s3StorageClasses, ", "))
+	}
+	return nil
+}
+
+// checkGCSSettings checks the Google Cloud Storage settings of size, if it
+// is uploaded.
+func checkGCSSettings(size string) error {
+	bucket := getSizeEnv("GCS_BUCKET", size)
+	if bucket == "" {
+		return nil
+	}
+	if strings.Contains(bucket, "/") || strings.HasPrefix(bucket, "gs:") {
+		return fmt.Errorf("invalid value for GCS_BUCKET: %q is not a bucket name; put the path in GCS_PREFIX", bucket)
+	}
+	if class := getSizeEnv("GCS_STORAGE_CLASS", size); class != "" && !slices.Contains(gcsStorageClasses, class) {
+		return fmt.Errorf("invalid value for GCS_STORAGE_CLASS: %q is not one of %s", class, strings.Join(gcsStorageClasses, ", "))
+	}
+	if _, err := getSizeEnvBool("GCS_GZIP_MANIFESTS", size, false); err != nil {
+		return err
+	}
+	return nil
+}
+
+// uploadS3 copies the outputs written for input at size to the size's
+// S3_BUCKET with the aws CLI, which takes its credentials and region from the
+// usual AWS environment variables and files. Nothing is uploaded when no
+// bucket is set. Objects get S3_STORAGE_CLASS and S3_CACHE_CONTROL, and the
+// content type of their format.
+func uploadS3(input inputFile, size string, written []string) error {
+	bucket := getSizeEnv("S3_BUCKET", size)
+	if bucket == "" {
+		return nil
+	}
+	if err := checkS3Settings(size); err != nil {
+		return err
+	}
+	prefix := getSizeEnv("S3_PREFIX", size)
+	if prefix == "" {
+		prefix = DefaultUploadPrefix
+	}
+
+	for _, file := range written {
+		url := "s3://" + bucket + "/" + uploadKey(prefix, input, size, file)
+		args := []string{"s3", "cp", file, url, "--only-show-errors"}
+		if class := getSizeEnv("S3_STORAGE_CLASS", size); class != "" {
+			args = append(args, "--storage-class", class)
+		}
+		if cacheControl := getSizeEnv("S3_CACHE_CONTROL", size); cacheControl != "" {
+			args = append(args, "--cache-control", cacheControl)
+		}
+		if contentType := contentType(file); contentType != "" {
+			args = append(args, "--content-type", contentType)
+		}
+		output, err := exec.Command("aws", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to upload %s to %s: aws failed: %w, output: %s", file, url, err, string(output))
+		}
+		log.Printf("[INFO] Uploaded %s to %s", file, url)
+	}
+	return nil
+}
+
+// uploadGCS copies the outputs written for input at size to the size's
+// GCS_BUCKET with gcloud, which uses its configured account. Nothing is
+// uploaded when no bucket is set. Objects get GCS_STORAGE_CLASS,
+// GCS_CACHE_CONTROL and the content type of their format; with
+// GCS_GZIP_MANIFESTS, <name>.formats.json manifests are stored gzipped and
+// served with Content-Encoding: gzip.
+func uploadGCS(input inputFile, size string, written []string) error {
+	bucket := getSizeEnv("GCS_BUCKET", size)
+	if bucket == "" {
+		return nil
+	}
+	if err := checkGCSSettings(size); err != nil {
+		return err
+	}
+	prefix := getSizeEnv("GCS_PREFIX", size)
+	if prefix == "" {
+		prefix = DefaultUploadPrefix
+	}
+	gzipManifests, _ := getSizeEnvBool("GCS_GZIP_MANIFESTS", size, false)
+
+	for _, file := range written {
+		url := "gs://" + bucket + "/" + uploadKey(prefix, input, size, file)
+		gzip := gzipManifests && strings.HasSuffix(file, ".formats.json")
+		if err := gcsCopy(file, url, getSizeEnv("GCS_STORAGE_CLASS", size), getSizeEnv("GCS_CACHE_CONTROL", size), gzip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadManifestGCS copies a manifest the run wrote, the -manifest run
+// manifest, a -srcset snippet or a -metadata-json sidecar, to GCS_BUCKET.
+// It is named by its path below baseDir, or its file name when it is
+// elsewhere, after GCS_MANIFEST_PREFIX. Manifests change with every run, so
+// they get neither GCS_CACHE_CONTROL nor GCS_STORAGE_CLASS; with
+// GCS_GZIP_MANIFESTS they are stored gzipped.
+func uploadManifestGCS(file, baseDir string) error {
+	bucket := os.Getenv("GCS_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	if err := checkGCSSettings(""); err != nil {
+		return err
+	}
+	gzipManifests, _ := getSizeEnvBool("GCS_GZIP_MANIFESTS", "", false)
+
+	name := filepath.Base(file)
+	if rel, err := filepath.Rel(baseDir, file); err == nil && !strings.HasPrefix(rel, "..") {
+		name = filepath.ToSlash(rel)
+	}
+	key := strings.TrimPrefix(path.Join(os.Getenv("GCS_MANIFEST_PREFIX"), name), "/")
+	return gcsCopy(file, "gs://"+bucket+"/"+key, "", "", gzipManifests)
+}
+
+// gcsCopy uploads file to url with gcloud, with the storage class and
+// Cache-Control header if set, and the content type of its format. gzip
+// stores it gzipped, served with Content-Encoding: gzip.
+func gcsCopy(file, url, class, cacheControl string, gzip bool) error {
+	args := []string{"storage", "cp", file, url, "--quiet"}
+	if class != "" {
+		args = append(args, "--storage-class", class)
+	}
+	if cacheControl != "" {
+		args = append(args, "--cache-control", cacheControl)
+	}
+	if contentType := contentType(file); contentType != "" {
+		args = append(args, "--content-type", contentType)
+	}
+	if gzip {
+		args = append(args, "--gzip-local-all")
+	}
+	output, err := exec.Command("gcloud", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to %s: gcloud failed: %w, output: %s", file, url, err, string(output))
+	}
+	log.Printf("[INFO] Uploaded %s to %s", file, url)
+	return nil
+}
+
+// contentType returns the MIME type of an output file, or "" to let the
+// uploading tool guess.
+func contentType(file string) string {
+	switch {
+	case strings.HasSuffix(file, ".json"):
+		return "application/json"
+	case strings.HasSuffix(file, ".html"):
+		return "text/html; charset=utf-8"
+	}
+	return mimeTypes[strings.ToLower(strings.TrimPrefix(filepath.Ext(file), "."))]
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// runConfigValidate implements "config validate": it loads the
+// configuration, checks every size and the files and directories it refers
+// to, and reports all problems at once. It returns the exit status.
+func runConfigValidate(args []string) int {
+	flags := flag.NewFlagSet("config validate", flag.ExitOnError)
+	envFlag := flags.String("env", DefaultENV, "Path to the .env file")
+	profileFlag := flags.String("profile", "", "Config profile to check (default: PROFILE)")
+	var setFlag keyValues
+	flags.Var(&setFlag, "set", "Override a config value, KEY=VALUE (repeatable)")
+	flags.Parse(args)
+
+	envSet := false
+	flags.Visit(func(f *flag.Flag) { envSet = envSet || f.Name == "env" })
+	if _, err := loadConfig(*envFlag, envSet, *profileFlag, configOverrides(setFlag, nil, nil)); err != nil {
+		log.Printf("[ERROR] %v", err)
+		return 1
+	}
+
+	problems := validateConfig()
+	for _, problem := range problems {
+		log.Printf("[ERROR] %v", problem)
+	}
+	if len(problems) > 0 {
+		log.Printf("[ERROR] %s has %d problems", *envFlag, len(problems))
+		return 1
+	}
+	log.Printf("[INFO] %s is valid", *envFlag)
+	return 0
+}
+
+// validateConfig checks the loaded configuration and returns every problem
+// found.
+func validateConfig() []error {
+	var problems []error
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	for _, key := range []string{"OUTPUT_BASE_DIR", "OWNER_USER"} {
+		if os.Getenv(key) == "" {
+			check(fmt.Errorf("%s is not set", key))
+		}
+	}
+	if dir := os.Getenv("OUTPUT_BASE_DIR"); dir != "" {
+		check(checkWritable(dir))
+	}
+	if owner := os.Getenv("OWNER_USER"); owner != "" {
+		if _, err := user.Lookup(owner); err != nil {
+			check(fmt.Errorf("invalid value for OWNER_USER: %w", err))
+		}
+	}
+
+	sizes, err := configuredSizes()
+	if err != nil {
+		check(err)
+		sizes = builtinSizes
+	}
+	for _, size := range sizes {
+		problems = append(problems, validateSize(size)...)
+	}
+	if _, err := defaultSizes(sizes); err != nil {
+		check(err)
+	}
+	if _, err := collisionStrategy(); err != nil {
+		check(err)
+	}
+	if _, err := breakpointLadder(); err != nil {
+		check(err)
+	}
+	if _, err := colorProfileMode(); err != nil {
+		check(err)
+	}
+	return problems
+}
+
+// validateSize checks the settings of one size.
+func validateSize(size string) []error {
+	var errs []error
+	key := "DIMENSION_" + strings.ToUpper(size)
+	if value := os.Getenv(key); value != "" {
+		if _, err := parseDimension(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value for %s: %w", key, err))
+		}
+	} else if !slices.Contains(builtinSizes, size) {
+		errs = append(errs, fmt.Errorf("%s is not set", key))
+	}
+	if _, err := parseFormats(getSizeEnv("OUTPUT_FORMATS", size)); err != nil {
+		errs = append(errs, fmt.Errorf("invalid value for OUTPUT_FORMATS: %w", err))
+	}
+	if _, err := upscalePolicy(size); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := resampleFilterName(imageOptions{Size: size}); err != nil {
+		errs = append(errs, fmt.Errorf("invalid value for RESIZE_FILTER: %w", err))
+	}
+
+	if _, err := outputPath("", inputFile{Path: "input.jpg"}, size, "output.jpg"); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseDensities(getSizeEnv("DPR", size)); err != nil {
+		errs = append(errs, fmt.Errorf("invalid value for DPR: %w", err))
+	}
+	if err := checkS3Settings(size); err != nil {
+		errs = append(errs, err)
+	}
+	if err := checkGCSSettings(size); err != nil {
+		errs = append(errs, err)
+	}
+	if _, _, err := stripMode(size, false); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := copyTags(size); err != nil {
+		errs = append(errs, err)
+	}
+	if hashNames, err := getSizeEnvBool("HASH_NAMES", size, false); err != nil {
+		errs = append(errs, err)
+	} else if hashNames {
+		if _, err := hashLength(size); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Watermark and font files of every layer
+	prefixes := []string{"WATERMARK"}
+	if layers := getSizeEnv("WATERMARK_LAYERS", size); layers != "" {
+		prefixes = nil
+		for _, name := range strings.Split(layers, ",") {
+			if name = strings.ToUpper(strings.TrimSpace(name)); name != "" {
+				prefixes = append(prefixes, "WATERMARK_"+name)
+			}
+		}
+	}
+	for _, prefix := range prefixes {
+		for _, orientation := range []string{"", "_PORTRAIT", "_LANDSCAPE"} {
+			for _, name := range []string{"_FILE", "_FONT"} {
+				key := prefix + orientation + name
+				if file := getSizeEnv(key, size); file != "" {
+					if _, err := os.Stat(file); err != nil {
+						errs = append(errs, fmt.Errorf("invalid value for %s: %w", key, err))
+					}
+				}
+			}
+		}
+	}
+
+	for i, err := range errs {
+		errs[i] = fmt.Errorf("size %s: %w", size, err)
+	}
+	return errs
+}
+
+// checkWritable reports whether files can be created in dir, or in the
+// closest existing parent that it would be created in.
+func checkWritable(dir string) error {
+	for {
+		info, err := os.Stat(dir)
+		if errors.Is(err, fs.ErrNotExist) && filepath.Dir(dir) != dir {
+			dir = filepath.Dir(dir)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value for OUTPUT_BASE_DIR: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("invalid value for OUTPUT_BASE_DIR: %s is not a directory", dir)
+		}
+		break
+	}
+	f, err := os.CreateTemp(dir, ".go-scale-check-*")
+	if err != nil {
+		return fmt.Errorf("invalid value for OUTPUT_BASE_DIR: %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// defaultWatermarked lists the sizes that get a watermark with -w unless
+// WATERMARK is set for them.
+var defaultWatermarked = map[string]bool{"xl": true, "l": true, "m": true}
+
+// defaultWatermarkScale is the watermark width per size, as a percentage of
+// the watermark file's own width, unless WATERMARK_SCALE is set. Sizes not
+// listed, such as the ones named in SIZES, use the full width.
+var defaultWatermarkScale = map[string]float64{"xl": 100, "l": 66, "m": 33, "s": 100}
+
+// watermarkEnabled reports whether -w watermarks an output of size that is
+// width pixels wide: WATERMARK (per size, e.g. WATERMARK_S=true) selects the
+// sizes, by default the extra-large, large and medium ones, and outputs
+// narrower than WATERMARK_MIN_WIDTH are left alone.
+func watermarkEnabled(size string, width int) (bool, error) {
+	enabled, err := getSizeEnvBool("WATERMARK", size, defaultWatermarked[size])
+	if err != nil || !enabled {
+		return false, err
+	}
+	minWidth, err := getSizeEnvInt("WATERMARK_MIN_WIDTH", size, 0)
+	if err != nil {
+		return false, err
+	}
+	return width >= minWidth, nil
+}
+
+// watermarkLayer looks up the settings of one watermark layer for an output
+// of size. A setting KEY is read from prefix_ORIENTATION_KEY when that is
+// set, so portrait and landscape outputs can be configured differently (e.g.
+// WATERMARK_PORTRAIT_POSITION), and from prefix_KEY otherwise. Both can be
+// overridden per size, and settings in overrides take precedence over all
+// of them.
+type watermarkLayer struct {
+	prefix      string // WATERMARK, or WATERMARK_<NAME> for named layers
+	orientation string // PORTRAIT, LANDSCAPE or "" for square outputs
+	size        string
+	overrides   map[string]string // settings by name, e.g. FILE, nil for none
+}
+
+// key returns the environment key the layer's setting name is read from.
+func (l watermarkLayer) key(name string) string {
+	if l.orientation != "" {
+		if key := l.prefix + "_" + l.orientation + "_" + name; getSizeEnv(key, l.size) != "" {
+			return key
+		}
+	}
+	return l.prefix + "_" + name
+}
+
+// get returns the layer's setting name.
+func (l watermarkLayer) get(name string) string {
+	if value, ok := l.overrides[name]; ok {
+		return value
+	}
+	return getSizeEnv(l.key(name), l.size)
+}
+
+// imageOrientation returns PORTRAIT for bounds taller than wide, LANDSCAPE
+// for wider than tall and "" for squares.
+func imageOrientation(bounds image.Rectangle) string {
+	switch {
+	case bounds.Dy() > bounds.Dx():
+		return "PORTRAIT"
+	case bounds.Dx() > bounds.Dy():
+		return "LANDSCAPE"
+	}
+	return ""
+}
+
+// applyWatermark overlays the size's watermark layers on img in order.
+// WATERMARK_LAYERS names them, e.g. "logo,credit"; each layer is configured
+// with its own keys such as WATERMARK_LOGO_FILE and WATERMARK_CREDIT_TEXT.
+// Without WATERMARK_LAYERS, the single layer uses the plain WATERMARK_ keys.
+// A per-file opts.Watermark replaces the layers with a single one that uses
+// its FILE or TEXT and the plain WATERMARK_ keys for the rest.
+func applyWatermark(img image.Image, inputFile string, opts imageOptions) (image.Image, error) {
+	orientation := imageOrientation(img.Bounds())
+	value := getSizeEnv("WATERMARK_LAYERS", opts.Size)
+	if value == "" || opts.Watermark != nil {
+		return applyWatermarkLayer(img, inputFile, watermarkLayer{"WATERMARK", orientation, opts.Size, opts.Watermark}, opts)
+	}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		var err error
+		if img, err = applyWatermarkLayer(img, inputFile, watermarkLayer{"WATERMARK_" + name, orientation, opts.Size, nil}, opts); err != nil {
+			return nil, fmt.Errorf("watermark layer %s: %w", name, err)
+		}
+	}
+	return img, nil
+}
+
+// applyWatermarkLayer overlays one watermark layer on img. Its settings are
+// read from the layer's keys:
+//
+//	_FILE                    watermark image, scaled by watermarkWidth
+//	_TEXT                    text rendered by textWatermark instead of _FILE
+//	_ROTATE                  angle in degrees, counter-clockwise
+//	_POSITION                center (default), an edge or a corner
+//	_MARGIN                  distance kept from every edge
+//	_OFFSET_X, _OFFSET_Y     further shift, in pixels or a percentage
+//	_OPACITY                 0-1, unless opts.Opacity overrides it
+//	_BLEND                   normal (default), multiply, screen or overlay
+//	_MODE, _SPACING          tile repeats the layer across the whole image
+func applyWatermarkLayer(img image.Image, inputFile string, layer watermarkLayer, opts imageOptions) (image.Image, error) {
+	var resizedWatermark image.Image
+	var err error
+	if layer.get("TEXT") != "" {
+		if resizedWatermark, err = textWatermark(inputFile, layer, img.Bounds().Dy()); err != nil {
+			return nil, err
+		}
+	} else {
+		file := layer.get("FILE")
+		if file == "" {
+			return nil, fmt.Errorf("%s is not set for size %s", layer.key("FILE"), layer.size)
+		}
+		watermark, err := imaging.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open watermark image: %w", err)
+		}
+
+		width, err := watermarkWidth(layer, watermark.Bounds().Dx(), img.Bounds().Dx())
+		if err != nil {
+			return nil, err
+		}
+		resizedWatermark = imaging.Resize(watermark, width, 0, imaging.Lanczos)
+	}
+
+	angle, err := getSizeEnvFloat(layer.key("ROTATE"), layer.size, 0)
+	if err != nil {
+		return nil, err
+	}
+	if angle != 0 {
+		resizedWatermark = imaging.Rotate(resizedWatermark, angle, color.Transparent)
+	}
+
+	var opacity float64
+	if opts.Opacity != nil {
+		opacity = *opts.Opacity
+	} else {
+		if opacity, err = getSizeEnvFloat(layer.key("OPACITY"), layer.size, 1); err != nil {
+			return nil, err
+		}
+		if opacity < 0 || opacity > 1 {
+			return nil, fmt.Errorf("invalid value for %s: %v is not between 0 and 1", layer.key("OPACITY"), opacity)
+		}
+	}
+
+	blend := strings.ToLower(layer.get("BLEND"))
+	if _, ok := blendModes[blend]; !ok {
+		return nil, fmt.Errorf("invalid value for %s: %q", layer.key("BLEND"), blend)
+	}
+
+	watermark := imaging.Clone(resizedWatermark)
+	switch mode := layer.get("MODE"); mode {
+	case "", "single":
+	case "tile":
+		return tileWatermark(img, watermark, layer, opacity, blend)
+	default:
+		return nil, fmt.Errorf("invalid value for %s: %q", layer.key("MODE"), mode)
+	}
+
+	position := strings.ToLower(layer.get("POSITION"))
+	if position == "" {
+		position = "center"
+	}
+	anchor, ok := anchors[position]
+	if !ok {
+		return nil, fmt.Errorf("invalid value for %s: %q", layer.key("POSITION"), position)
+	}
+	bounds := img.Bounds()
+	offset, err := watermarkOffset(layer, bounds)
+	if err != nil {
+		return nil, err
+	}
+
+	margin, err := watermarkMargin(layer, bounds)
+	if err != nil {
+		return nil, err
+	}
+
+	pt := anchorPoint(anchor, bounds.Inset(margin), watermark.Bounds().Size(), offset)
+	dst := imaging.Clone(img)
+	composite(dst, watermark, pt, opacity, blend)
+	return dst, nil
+}
+
+// watermarkWidth returns the width the watermark is scaled to on an output
+// imageWidth pixels wide. The layer's _WIDTH sizes it relative to the output, in
+// pixels or as a percentage of imageWidth, so it looks the same on any
+// aspect ratio; otherwise its _SCALE is a percentage of the watermark's
+// own width.
+func watermarkWidth(layer watermarkLayer, watermarkWidth, imageWidth int) (int, error) {
+	if value := layer.get("WIDTH"); value != "" {
+		width, err := parseLength(value, imageWidth)
+		if err != nil || width <= 0 {
+			return 0, fmt.Errorf("invalid value for %s: %q", layer.key("WIDTH"), value)
+		}
+		return max(1, int(width+0.5)), nil
+	}
+
+	defaultScale, ok := defaultWatermarkScale[layer.size]
+	if !ok {
+		defaultScale = 100
+	}
+	scale, err := getSizeEnvFloat(layer.key("SCALE"), layer.size, defaultScale)
+	if err != nil {
+		return 0, err
+	}
+	if scale <= 0 {
+		return 0, fmt.Errorf("invalid value for %s: %v must be positive", layer.key("SCALE"), scale)
+	}
+	return max(1, int(float64(watermarkWidth)*scale/100+0.5)), nil
+}
+
+// DefaultWatermarkSpacing is the gap between tiled watermarks, as a
+// percentage of the output width.
+const DefaultWatermarkSpacing = "10%"
+
+// tileWatermark repeats watermark over img in rows the layer's _SPACING apart
+// (pixels or a percentage of the image width). Every other row is shifted by
+// half a step, so the copies line up diagonally.
+func tileWatermark(img image.Image, watermark *image.NRGBA, layer watermarkLayer, opacity float64, blend string) (image.Image, error) {
+	bounds := img.Bounds()
+	value := layer.get("SPACING")
+	if value == "" {
+		value = DefaultWatermarkSpacing
+	}
+	spacing, err := parseLength(value, bounds.Dx())
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for %s: %w", layer.key("SPACING"), err)
+	}
+
+	wm := watermark.Bounds().Size()
+	stepX, stepY := wm.X+int(spacing+0.5), wm.Y+int(spacing+0.5)
+	if stepX <= 0 || stepY <= 0 {
+		return img, nil
+	}
+	dst := imaging.Clone(img)
+	for row, y := 0, bounds.Min.Y; y < bounds.Max.Y; row, y = row+1, y+stepY {
+		x := bounds.Min.X
+		if row%2 == 1 {
+			x -= stepX / 2
+		}
+		for ; x < bounds.Max.X; x += stepX {
+			composite(dst, watermark, image.Pt(x, y), opacity, blend)
+		}
+	}
+	return dst, nil
+}
+
+// watermarkMargin reads the layer's _MARGIN, the distance kept from every
+// edge in pixels or as a percentage of the shorter side of bounds.
+func watermarkMargin(layer watermarkLayer, bounds image.Rectangle) (int, error) {
+	value := layer.get("MARGIN")
+	if value == "" {
+		return 0, nil
+	}
+	margin, err := parseLength(value, min(bounds.Dx(), bounds.Dy()))
+	if err != nil {
+		return 0, fmt.Errorf("invalid value for %s: %w", layer.key("MARGIN"), err)
+	}
+	return int(margin + 0.5), nil
+}
+
+// watermarkOffset reads the layer's _OFFSET_X and _OFFSET_Y, relative to
+// bounds for percentages.
+func watermarkOffset(layer watermarkLayer, bounds image.Rectangle) (image.Point, error) {
+	var offset image.Point
+	for _, axis := range []struct {
+		key  string
+		base int
+		dst  *int
+	}{
+		{layer.key("OFFSET_X"), bounds.Dx(), &offset.X},
+		{layer.key("OFFSET_Y"), bounds.Dy(), &offset.Y},
+	} {
+		value := getSizeEnv(axis.key, layer.size)
+		if value == "" {
+			continue
+		}
+		n, err := parseLength(value, axis.base)
+		if err != nil {
+			return image.Point{}, fmt.Errorf("invalid value for %s: %w", axis.key, err)
+		}
+		*axis.dst = int(n + 0.5)
+	}
+	return offset, nil
+}
+
+// anchorPoint returns where an overlay of size fg goes inside bg for anchor.
+// offset moves it away from the edges it is anchored to, and right and down
+// for centered axes.
+func anchorPoint(anchor imaging.Anchor, bg image.Rectangle, fg image.Point, offset image.Point) image.Point {
+	x := bg.Min.X + (bg.Dx()-fg.X)/2 + offset.X
+	y := bg.Min.Y + (bg.Dy()-fg.Y)/2 + offset.Y
+	switch anchor {
+	case imaging.Left, imaging.TopLeft, imaging.BottomLeft:
+		x = bg.Min.X + offset.X
+	case imaging.Right, imaging.TopRight, imaging.BottomRight:
+		x = bg.Max.X - fg.X - offset.X
+	}
+	switch anchor {
+	case imaging.Top, imaging.TopLeft, imaging.TopRight:
+		y = bg.Min.Y + offset.Y
+	case imaging.Bottom, imaging.BottomLeft, imaging.BottomRight:
+		y = bg.Max.Y - fg.Y - offset.Y
+	}
+	return image.Pt(x, y)
+}
+
+// blendModes maps the _BLEND values to the function that mixes a backdrop
+// channel value b with a watermark channel value s, both between 0 and 1.
+var blendModes = map[string]func(b, s float64) float64{
+	"":       func(b, s float64) float64 { return s },
+	"normal": func(b, s float64) float64 { return s },
+	// multiply darkens: white in the watermark leaves the photo unchanged.
+	"multiply": func(b, s float64) float64 { return b * s },
+	// screen lightens: black in the watermark leaves the photo unchanged.
+	"screen": func(b, s float64) float64 { return 1 - (1-b)*(1-s) },
+	// overlay raises contrast, multiplying dark and screening light areas.
+	"overlay": func(b, s float64) float64 {
+		if b <= 0.5 {
+			return 2 * b * s
+		}
+		return 1 - 2*(1-b)*(1-s)
+	},
+}
+
+// composite draws src onto dst with its top-left corner at pt, at opacity
+// and mixed with the pixels below by the blend mode.
+func composite(dst, src *image.NRGBA, pt image.Point, opacity float64, blend string) {
+	mix := blendModes[blend]
+	srcBounds := src.Bounds()
+	r := image.Rectangle{Min: pt, Max: pt.Add(srcBounds.Size())}.Intersect(dst.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			j := src.PixOffset(srcBounds.Min.X+x-pt.X, srcBounds.Min.Y+y-pt.Y)
+			s := src.Pix[j : j+4 : j+4]
+			sa := float64(s[3]) / 255 * opacity
+			if sa == 0 {
+				continue
+			}
+			i := dst.PixOffset(x, y)
+			d := dst.Pix[i : i+4 : i+4]
+			da := float64(d[3]) / 255
+			outA := sa + da*(1-sa)
+			for c := 0; c < 3; c++ {
+				bc, sc := float64(d[c])/255, float64(s[c])/255
+				// Over a transparent backdrop there is nothing to blend with.
+				blended := (1-da)*sc + da*mix(bc, sc)
+				d[c] = clampUint8((sa*blended + da*(1-sa)*bc) / outA * 255)
+			}
+			d[3] = clampUint8(outA * 255)
+		}
+	}
+}